@@ -0,0 +1,16 @@
+package shedding
+
+import "context"
+
+type criticalityKey struct{}
+
+// WithCriticality returns a copy of ctx carrying crit
+func WithCriticality(ctx context.Context, crit Criticality) context.Context {
+	return context.WithValue(ctx, criticalityKey{}, crit)
+}
+
+// FromContext returns the criticality stored in ctx by WithCriticality, if any
+func FromContext(ctx context.Context) (Criticality, bool) {
+	crit, ok := ctx.Value(criticalityKey{}).(Criticality)
+	return crit, ok
+}
@@ -0,0 +1,17 @@
+package shedding
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFromContext(t *testing.T) {
+	if crit, ok := FromContext(context.Background()); ok {
+		t.Errorf("FromContext(Background) = %v, true, want no criticality", crit)
+	}
+	ctx := WithCriticality(context.Background(), SheddablePlus)
+	ctx = WithCriticality(ctx, CriticalPlus)
+	if crit, ok := FromContext(ctx); !ok || crit != CriticalPlus {
+		t.Errorf("FromContext = %v, %v, want the innermost CriticalPlus", crit, ok)
+	}
+}
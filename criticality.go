@@ -0,0 +1,63 @@
+// Package shedding provides load shedding primitives. Requests carry a
+// Criticality, and when there is not enough capacity to serve everything, the
+// least critical requests are shed first.
+package shedding
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Criticality is the importance of a request. Higher values are more critical,
+// and are shed last.
+type Criticality int
+
+// The standard criticality levels, from least to most critical
+const (
+	// Sheddable requests may be shed freely, and are expected to be retried
+	// later or not at all, e.g. batch work.
+	Sheddable Criticality = iota
+	// SheddablePlus requests may be shed, but their failure is visible, e.g.
+	// batch work with a deadline.
+	SheddablePlus
+	// Critical requests are the default for serving traffic; failure is
+	// user-visible.
+	Critical
+	// CriticalPlus requests are the most important, and are the last to be shed.
+	CriticalPlus
+)
+
+// AllCriticalities lists the standard criticality levels in ascending order
+var AllCriticalities = []Criticality{Sheddable, SheddablePlus, Critical, CriticalPlus}
+
+// IsValid reports whether c is one of the standard criticality levels
+func (c Criticality) IsValid() bool {
+	return c >= Sheddable && c <= CriticalPlus
+}
+
+var criticalityNames = map[Criticality]string{
+	Sheddable:     "SHEDDABLE",
+	SheddablePlus: "SHEDDABLE_PLUS",
+	Critical:      "CRITICAL",
+	CriticalPlus:  "CRITICAL_PLUS",
+}
+
+// String returns the name of a standard criticality level, such as
+// "CRITICAL_PLUS", or "Criticality(n)" for other values
+func (c Criticality) String() string {
+	if name, ok := criticalityNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Criticality(%d)", int(c))
+}
+
+// ParseCriticality parses the name of a standard criticality level, as
+// returned by Criticality.String. It is case insensitive.
+func ParseCriticality(s string) (Criticality, error) {
+	for c, name := range criticalityNames {
+		if strings.EqualFold(s, name) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown criticality %q", s)
+}
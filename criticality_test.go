@@ -0,0 +1,65 @@
+package shedding
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAllCriticalities(t *testing.T) {
+	if !slices.IsSorted(AllCriticalities) {
+		t.Errorf("AllCriticalities = %v, want ascending order", AllCriticalities)
+	}
+	for _, c := range AllCriticalities {
+		if !c.IsValid() {
+			t.Errorf("%d.IsValid() = false, want true", int(c))
+		}
+	}
+	if got := AllCriticalities[0]; got != Sheddable {
+		t.Errorf("least critical level is %d, want Sheddable", int(got))
+	}
+	if got := AllCriticalities[len(AllCriticalities)-1]; got != CriticalPlus {
+		t.Errorf("most critical level is %d, want CriticalPlus", int(got))
+	}
+}
+
+func TestIsValid(t *testing.T) {
+	for _, c := range []Criticality{-1, CriticalPlus + 1, 7} {
+		if c.IsValid() {
+			t.Errorf("%d.IsValid() = true, want false", int(c))
+		}
+	}
+}
+
+func TestCriticalityString(t *testing.T) {
+	for _, tc := range []struct {
+		c    Criticality
+		want string
+	}{
+		{Sheddable, "SHEDDABLE"},
+		{SheddablePlus, "SHEDDABLE_PLUS"},
+		{Critical, "CRITICAL"},
+		{CriticalPlus, "CRITICAL_PLUS"},
+		{7, "Criticality(7)"},
+		{-1, "Criticality(-1)"},
+	} {
+		if got := tc.c.String(); got != tc.want {
+			t.Errorf("Criticality(%d).String() = %q, want %q", int(tc.c), got, tc.want)
+		}
+	}
+}
+
+func TestParseCriticality(t *testing.T) {
+	for _, c := range AllCriticalities {
+		if got, err := ParseCriticality(c.String()); err != nil || got != c {
+			t.Errorf("ParseCriticality(%q) = %v, %v, want %v", c.String(), got, err, c)
+		}
+	}
+	if got, err := ParseCriticality("critical_plus"); err != nil || got != CriticalPlus {
+		t.Errorf("ParseCriticality(\"critical_plus\") = %v, %v, want CRITICAL_PLUS", got, err)
+	}
+	for _, s := range []string{"", "URGENT", "Criticality(7)", "2", " CRITICAL"} {
+		if got, err := ParseCriticality(s); err == nil {
+			t.Errorf("ParseCriticality(%q) = %v, want an error", s, got)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package dispatch admits requests from a queue.Queue to a fixed pool of
+// workers, for the shedhttp and shedgrpc packages. Each request is inserted
+// with a Ticket, and the request's own goroutine waits on the Ticket until it is
+// either dequeued by a worker, shed or discarded.
+package dispatch
+
+import (
+	"context"
+	"sync"
+
+	"github.com/asuffield/shedding"
+	"github.com/asuffield/shedding/queue"
+)
+
+// Outcome is the result of waiting for a Ticket
+type Outcome int
+
+const (
+	Granted   Outcome = iota // The request was dequeued, and should now be served
+	Shed                     // The request was shed
+	Closed                   // The queue was closed
+	Discarded                // The request was discarded by Clear or RemoveFunc
+	Cancelled                // The request's context was done first
+)
+
+// Ticket tracks a single request
+type Ticket struct {
+	granted   chan struct{} // closed when a worker dequeues the request
+	finished  chan struct{} // closed by Done
+	abandoned chan struct{} // closed by Wait if the request's context is done
+	discarded chan struct{} // closed when the queue discards the request
+	shed      chan queue.ShedReason
+}
+
+func NewTicket() *Ticket {
+	return &Ticket{
+		granted:   make(chan struct{}),
+		finished:  make(chan struct{}),
+		abandoned: make(chan struct{}),
+		discarded: make(chan struct{}),
+		shed:      make(chan queue.ShedReason, 1),
+	}
+}
+
+// Done releases the worker, once a Granted request has been served
+func (t *Ticket) Done() {
+	close(t.finished)
+}
+
+// Rejected returns the outcome for a request that Insert rejected: Shed, if
+// it was shed on the way in, or Closed if the queue is closed or draining
+func (t *Ticket) Rejected() (Outcome, queue.ShedReason) {
+	select {
+	case reason := <-t.shed:
+		return Shed, reason
+	default:
+		return Closed, 0
+	}
+}
+
+// Pool is a set of workers consuming from a queue
+type Pool struct {
+	closed chan struct{}
+}
+
+// Start starts n workers consuming from q, and installs q.Config.OnShed and
+// q.Config.OnDiscard, calling any previous hooks. ticket returns the Ticket a
+// value was inserted with. Start must be called before q is used. The workers exit when q is
+// closed.
+func Start[T any](q *queue.Queue[T], n int, ticket func(T) *Ticket) *Pool {
+	onShed := q.Config.OnShed
+	q.Config.OnShed = func(crit shedding.Criticality, v T, reason queue.ShedReason) {
+		ticket(v).shed <- reason
+		if onShed != nil {
+			onShed(crit, v, reason)
+		}
+	}
+	onDiscard := q.Config.OnDiscard
+	q.Config.OnDiscard = func(crit shedding.Criticality, v T) {
+		close(ticket(v).discarded)
+		if onDiscard != nil {
+			onDiscard(crit, v)
+		}
+	}
+
+	p := &Pool{closed: make(chan struct{})}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				v, err := q.RemoveWait(context.Background())
+				if err != nil {
+					return
+				}
+				t := ticket(v)
+				close(t.granted)
+				select {
+				case <-t.finished:
+				case <-t.abandoned:
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(p.closed)
+	}()
+	return p
+}
+
+// Wait blocks until t's request is dequeued, shed or discarded, the queue is
+// closed, or ctx is done. The request must have been accepted by Insert; use
+// Rejected for one that was not. If the outcome is Granted, the caller must call t.Done when
+// it has finished serving the request; if it is Cancelled, a worker that
+// dequeues the request later moves straight on to the next one.
+func (p *Pool) Wait(ctx context.Context, t *Ticket) (Outcome, queue.ShedReason) {
+	select {
+	case <-t.granted:
+		return Granted, 0
+	case reason := <-t.shed:
+		return Shed, reason
+	case <-t.discarded:
+		return Discarded, 0
+	case <-p.closed:
+		return Closed, 0
+	case <-ctx.Done():
+		close(t.abandoned)
+		return Cancelled, 0
+	}
+}
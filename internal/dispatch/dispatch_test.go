@@ -0,0 +1,86 @@
+package dispatch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/asuffield/shedding/queue"
+)
+
+type request struct {
+	name   string
+	ticket *Ticket
+}
+
+func start(n int) (*queue.Queue[*request], *Pool) {
+	q := &queue.Queue[*request]{}
+	return q, Start(q, n, func(r *request) *Ticket { return r.ticket })
+}
+
+func insert(q *queue.Queue[*request], ctx context.Context, name string) *request {
+	r := &request{name: name, ticket: NewTicket()}
+	q.Insert(ctx, shedding.Sheddable, r, nil)
+	return r
+}
+
+func TestWaitGranted(t *testing.T) {
+	q, p := start(1)
+	defer q.Close()
+	r := insert(q, context.Background(), "a")
+	if outcome, _ := p.Wait(context.Background(), r.ticket); outcome != Granted {
+		t.Fatalf("Wait() = %v, want Granted", outcome)
+	}
+	r.ticket.Done()
+}
+
+func TestWaitDiscarded(t *testing.T) {
+	q, p := start(1)
+	defer q.Close()
+	busy := insert(q, context.Background(), "busy")
+	if outcome, _ := p.Wait(context.Background(), busy.ticket); outcome != Granted {
+		t.Fatalf("Wait() = %v, want Granted", outcome)
+	}
+	cleared := insert(q, context.Background(), "cleared")
+	removed := insert(q, context.Background(), "removed")
+
+	q.RemoveFunc(func(_ shedding.Criticality, r *request) bool { return r == removed })
+	if outcome, _ := p.Wait(context.Background(), removed.ticket); outcome != Discarded {
+		t.Errorf("Wait() after RemoveFunc = %v, want Discarded", outcome)
+	}
+	q.Clear()
+	if outcome, _ := p.Wait(context.Background(), cleared.ticket); outcome != Discarded {
+		t.Errorf("Wait() after Clear = %v, want Discarded", outcome)
+	}
+	busy.ticket.Done()
+}
+
+func TestWaitCancelled(t *testing.T) {
+	q, p := start(1)
+	defer q.Close()
+	busy := insert(q, context.Background(), "busy")
+	if outcome, _ := p.Wait(context.Background(), busy.ticket); outcome != Granted {
+		t.Fatalf("Wait() = %v, want Granted", outcome)
+	}
+
+	// Wait on a request that is still queued returns once its context is done,
+	// without waiting for the queue to shed it
+	waiting := insert(q, context.Background(), "waiting")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if outcome, _ := p.Wait(ctx, waiting.ticket); outcome != Cancelled {
+		t.Fatalf("Wait() = %v, want Cancelled", outcome)
+	}
+
+	// The worker dequeues the abandoned request without waiting for Done, and
+	// moves on to the next
+	busy.ticket.Done()
+	next := insert(q, context.Background(), "next")
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if outcome, _ := p.Wait(ctx, next.ticket); outcome != Granted {
+		t.Fatalf("Wait() after an abandoned request = %v, want Granted", outcome)
+	}
+	next.ticket.Done()
+}
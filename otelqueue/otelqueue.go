@@ -0,0 +1,49 @@
+// Package otelqueue traces the time elements spend in a queue.Queue with
+// OpenTelemetry
+package otelqueue
+
+import (
+	"context"
+
+	"github.com/asuffield/shedding"
+	"github.com/asuffield/shedding/queue"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer implements queue.Tracer. Each element gets a span, a child of the
+// context it was inserted with, which ends when the element is dequeued or
+// shed.
+type Tracer struct {
+	Tracer   trace.Tracer
+	SpanName string // defaults to "queue"
+}
+
+var _ queue.Tracer = Tracer{}
+
+func (t Tracer) Start(ctx context.Context, crit shedding.Criticality) queue.Span {
+	name := t.SpanName
+	if name == "" {
+		name = "queue"
+	}
+	_, span := t.Tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attribute.String("shedding.criticality", crit.String())))
+	return otelSpan{span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) Dequeued() {
+	s.span.AddEvent("dequeued")
+	s.span.End()
+}
+
+func (s otelSpan) Shed(reason queue.ShedReason) {
+	s.span.SetAttributes(attribute.String("shedding.shed_reason", reason.String()))
+	s.span.SetStatus(codes.Error, "shed")
+	s.span.End()
+}
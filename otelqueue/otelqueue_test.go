@@ -0,0 +1,75 @@
+package otelqueue
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/asuffield/shedding"
+	"github.com/asuffield/shedding/queue"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recorder is a trace.Tracer which keeps the spans it starts
+type recorder struct {
+	noop.Tracer
+	spans []*span
+}
+
+type span struct {
+	noop.Span
+	name   string
+	parent context.Context
+	attrs  []attribute.KeyValue
+	events []string
+	status codes.Code
+	ended  bool
+}
+
+func (r *recorder) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	c := trace.NewSpanStartConfig(opts...)
+	s := &span{name: name, parent: ctx, attrs: c.Attributes()}
+	r.spans = append(r.spans, s)
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+func (s *span) SetAttributes(kv ...attribute.KeyValue) { s.attrs = append(s.attrs, kv...) }
+func (s *span) SetStatus(code codes.Code, _ string)    { s.status = code }
+func (s *span) End(...trace.SpanEndOption)             { s.ended = true }
+func (s *span) AddEvent(name string, _ ...trace.EventOption) {
+	s.events = append(s.events, name)
+}
+
+type key struct{}
+
+func TestTracer(t *testing.T) {
+	r := &recorder{}
+	q := &queue.Queue[string]{}
+	q.Config.Tracer = Tracer{Tracer: r}
+	q.Config.MaxLen = 1
+	ctx := context.WithValue(context.Background(), key{}, "parent")
+	q.Insert(ctx, shedding.Sheddable, "shed", nil)
+	q.Insert(ctx, shedding.Critical, "dequeued", nil)
+	q.Remove()
+
+	if len(r.spans) != 2 {
+		t.Fatalf("started %d spans, want 2", len(r.spans))
+	}
+	shed, dequeued := r.spans[0], r.spans[1]
+	for _, s := range r.spans {
+		if s.name != "queue" || s.parent.Value(key{}) != "parent" || !s.ended {
+			t.Errorf("span %q: want a span named queue, a child of the insert context, which has ended", s.name)
+		}
+	}
+	if !slices.Contains(shed.attrs, attribute.String("shedding.criticality", "SHEDDABLE")) ||
+		!slices.Contains(shed.attrs, attribute.String("shedding.shed_reason", "capacity")) ||
+		shed.status != codes.Error {
+		t.Errorf("shed span has attributes %v and status %v, want its criticality, reason and an error", shed.attrs, shed.status)
+	}
+	if !slices.Equal(dequeued.events, []string{"dequeued"}) || dequeued.status != codes.Unset {
+		t.Errorf("dequeued span has events %v and status %v, want a dequeued event only", dequeued.events, dequeued.status)
+	}
+}
@@ -0,0 +1,103 @@
+// Package promqueue exports metrics for a queue.Queue to Prometheus
+package promqueue
+
+import (
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/asuffield/shedding/queue"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Opts configures the exported metrics
+type Opts struct {
+	Namespace string
+	Subsystem string // defaults to "queue"
+	// Buckets for the wait time histogram, in seconds. Defaults to
+	// prometheus.DefBuckets.
+	Buckets []float64
+}
+
+// Metrics implements queue.Metrics by updating Prometheus metrics. Every metric
+// has a constant "queue" label, so several queues may be registered with
+// the same registry under different names.
+type Metrics struct {
+	inserted *prometheus.CounterVec
+	removed  *prometheus.CounterVec
+	shed     *prometheus.CounterVec
+	wait     *prometheus.HistogramVec
+}
+
+var _ queue.Metrics = (*Metrics)(nil)
+
+// Register creates metrics for q labelled with name, registers them with reg,
+// and installs them as q.Config.Metrics. It must be called before q is used.
+func Register[T any](reg prometheus.Registerer, name string, q *queue.Queue[T], opts Opts) error {
+	if opts.Subsystem == "" {
+		opts.Subsystem = "queue"
+	}
+	if opts.Buckets == nil {
+		opts.Buckets = prometheus.DefBuckets
+	}
+	labels := prometheus.Labels{"queue": name}
+
+	m := &Metrics{
+		inserted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "inserted_total",
+			Help:        "Number of elements inserted into the queue, including those shed on insert.",
+			ConstLabels: labels,
+		}, []string{"criticality"}),
+		removed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "removed_total",
+			Help:        "Number of elements dequeued.",
+			ConstLabels: labels,
+		}, []string{"criticality"}),
+		shed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "shed_total",
+			Help:        "Number of elements shed.",
+			ConstLabels: labels,
+		}, []string{"criticality", "reason"}),
+		wait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "wait_seconds",
+			Help:        "Time elements spent in the queue before being dequeued.",
+			ConstLabels: labels,
+			Buckets:     opts.Buckets,
+		}, []string{"criticality"}),
+	}
+	depth := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "length",
+		Help:        "Number of elements in the queue.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(q.Len()) })
+
+	for _, c := range []prometheus.Collector{m.inserted, m.removed, m.shed, m.wait, depth} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	q.Config.Metrics = m
+	return nil
+}
+
+func (m *Metrics) Inserted(crit shedding.Criticality) {
+	m.inserted.WithLabelValues(crit.String()).Inc()
+}
+
+func (m *Metrics) Removed(crit shedding.Criticality, waited time.Duration) {
+	m.removed.WithLabelValues(crit.String()).Inc()
+	m.wait.WithLabelValues(crit.String()).Observe(waited.Seconds())
+}
+
+func (m *Metrics) Shed(crit shedding.Criticality, reason queue.ShedReason) {
+	m.shed.WithLabelValues(crit.String(), reason.String()).Inc()
+}
@@ -0,0 +1,71 @@
+package promqueue
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/asuffield/shedding/queue"
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRegisterSeveralQueues(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	for _, name := range []string{"a", "b"} {
+		if err := Register(reg, name, &queue.Queue[string]{}, Opts{}); err != nil {
+			t.Fatalf("Register(%q) = %v", name, err)
+		}
+	}
+	if err := Register(reg, "a", &queue.Queue[string]{}, Opts{}); err == nil {
+		t.Error("registering a second queue named a succeeded, want an error")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &queue.Queue[string]{}
+	q.Config.Clock = mc
+	q.Config.MaxLen = 1
+	reg := prometheus.NewRegistry()
+	if err := Register(reg, "a", q, Opts{Namespace: "test", Buckets: []float64{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	q.Insert(context.Background(), shedding.Sheddable, "shed", nil)
+	q.Insert(context.Background(), shedding.Critical, "removed", nil)
+	mc.Add(500 * time.Millisecond)
+	q.Remove()
+	q.Insert(context.Background(), shedding.Sheddable, "queued", nil)
+
+	want := `
+# HELP test_queue_inserted_total Number of elements inserted into the queue, including those shed on insert.
+# TYPE test_queue_inserted_total counter
+test_queue_inserted_total{criticality="CRITICAL",queue="a"} 1
+test_queue_inserted_total{criticality="SHEDDABLE",queue="a"} 2
+# HELP test_queue_removed_total Number of elements dequeued.
+# TYPE test_queue_removed_total counter
+test_queue_removed_total{criticality="CRITICAL",queue="a"} 1
+# HELP test_queue_shed_total Number of elements shed.
+# TYPE test_queue_shed_total counter
+test_queue_shed_total{criticality="SHEDDABLE",queue="a",reason="capacity"} 1
+# HELP test_queue_wait_seconds Time elements spent in the queue before being dequeued.
+# TYPE test_queue_wait_seconds histogram
+test_queue_wait_seconds_bucket{criticality="CRITICAL",queue="a",le="1"} 1
+test_queue_wait_seconds_bucket{criticality="CRITICAL",queue="a",le="+Inf"} 1
+test_queue_wait_seconds_sum{criticality="CRITICAL",queue="a"} 0.5
+test_queue_wait_seconds_count{criticality="CRITICAL",queue="a"} 1
+# HELP test_queue_length Number of elements in the queue.
+# TYPE test_queue_length gauge
+test_queue_length{queue="a"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want),
+		"test_queue_inserted_total", "test_queue_removed_total", "test_queue_shed_total",
+		"test_queue_wait_seconds", "test_queue_length"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,61 @@
+package queue
+
+import (
+	"math"
+	"time"
+)
+
+// CoDelPolicy is a ShedPolicy after Controlled Delay (CoDel), which sheds
+// based on how long elements have been queued rather than their deadlines.
+// Once the sojourn time of the head element has stayed above Target for
+// Interval, it sheds from the head, at a rate which increases with the square
+// root of the number shed, until the sojourn time falls below Target again.
+// Deadlines and criticality are ignored. A CoDelPolicy holds state, so it must
+// not be shared between queues.
+type CoDelPolicy struct {
+	Target   time.Duration // acceptable sojourn time
+	Interval time.Duration // how long the sojourn time may exceed Target before shedding
+
+	firstAbove time.Time // when the sojourn time went above Target, or zero
+	dropping   bool
+	dropNext   time.Time // when to shed the next element, while dropping
+	count      int       // elements shed since dropping began
+}
+
+func (p *CoDelPolicy) Shed(elements []ElementView, now time.Time, _ time.Duration) []int {
+	i := 0 // number of elements shed from the head
+	above := func() bool {
+		return i < len(elements) && now.Sub(elements[i].Enqueued) >= p.Target
+	}
+
+	switch {
+	case !above():
+		p.firstAbove = time.Time{}
+		p.dropping = false
+	case p.firstAbove.IsZero():
+		p.firstAbove = now
+	case now.Sub(p.firstAbove) < p.Interval:
+	case !p.dropping:
+		p.dropping = true
+		p.count = 1
+		p.dropNext = now.Add(p.controlLaw())
+		i++
+	default:
+		for !now.Before(p.dropNext) && above() {
+			p.count++
+			p.dropNext = p.dropNext.Add(p.controlLaw())
+			i++
+		}
+	}
+
+	keep := make([]int, 0, len(elements)-i)
+	for ; i < len(elements); i++ {
+		keep = append(keep, i)
+	}
+	return keep
+}
+
+// controlLaw returns the time until the next element should be shed
+func (p *CoDelPolicy) controlLaw() time.Duration {
+	return time.Duration(float64(p.Interval) / math.Sqrt(float64(p.count)))
+}
@@ -0,0 +1,45 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/benbjohnson/clock"
+)
+
+func TestCoDelPolicy(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	q.Config.ShedPolicy = &CoDelPolicy{Target: 100 * time.Millisecond, Interval: time.Second}
+	check := func(when string, want int) {
+		t.Helper()
+		q.Peek()
+		if n := q.Len(); n != want {
+			t.Errorf("%s: Len() = %d, want %d", when, n, want)
+		}
+	}
+
+	for _, v := range []string{"a", "b", "c", "d"} {
+		q.Insert(context.Background(), shedding.Sheddable, v, nil)
+	}
+	mc.Add(50 * time.Millisecond)
+	check("below target", 4)
+	mc.Add(150 * time.Millisecond)
+	check("just above target", 4)
+	mc.Add(time.Second)
+	check("above target for an interval", 3)
+	check("before the next drop is due", 3)
+	mc.Add(time.Second)
+	check("still above target", 2)
+
+	q.Clear()
+	q.Insert(context.Background(), shedding.Sheddable, "fresh", nil)
+	mc.Add(50 * time.Millisecond)
+	check("back below target", 1)
+	mc.Add(time.Second)
+	check("above target again, but not yet for an interval", 1)
+}
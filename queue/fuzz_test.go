@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/benbjohnson/clock"
+)
+
+// FuzzShed runs a random sequence of operations against a queue, with
+// contexts cancelled concurrently, and checks that nothing panics, that Len
+// stays within what was inserted, and that every cancel function is called
+// exactly once by the time the queue is closed
+func FuzzShed(f *testing.F) {
+	f.Add([]byte{0, 1, 2, 3, 4, 5, 6, 7})
+	f.Add([]byte{0, 0, 0, 0, 3, 3, 1, 1, 2, 6, 6, 7, 0, 4, 5})
+	f.Add([]byte{0x10, 0x20, 0x31, 0x42, 0x53, 0x64, 0x75, 0x86, 0x97, 0xa0, 0xb1})
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		mc := clock.NewMock()
+		mc.Set(time.Now())
+		q := &Queue[int]{}
+		q.Config.Clock = mc
+		q.Config.TimingHistory = 4
+		q.Config.MaxLen = 16
+		q.Config.AgingAfter = time.Second
+
+		var cancels []context.CancelFunc
+		var calls []*atomic.Int32
+		live := 0 // inserted and not yet removed, so an upper bound on Len
+		for i, op := range ops {
+			arg := int(op >> 3)
+			switch op & 7 {
+			case 0, 1:
+				// Insert, with a deadline or cancellable context
+				var ctx context.Context
+				var cancel context.CancelFunc
+				if op&1 == 0 {
+					ctx, cancel = context.WithDeadline(context.Background(), mc.Now().Add(time.Duration(arg)*100*time.Millisecond))
+				} else {
+					ctx, cancel = context.WithCancel(context.Background())
+				}
+				n := new(atomic.Int32)
+				cancels, calls = append(cancels, cancel), append(calls, n)
+				if q.Insert(ctx, shedding.Criticality(arg%4), i, func() { n.Add(1) }) {
+					live++
+				}
+			case 2:
+				// Cancel one, concurrently with whatever comes next
+				if len(cancels) > 0 {
+					go cancels[arg%len(cancels)]()
+				}
+			case 3:
+				if _, ok := q.Remove(); ok {
+					live--
+				}
+			case 4:
+				live -= len(q.RemoveN(arg % 4))
+			case 5:
+				mc.Add(time.Duration(arg) * 50 * time.Millisecond)
+			case 6:
+				q.Peek()
+				q.Stats()
+			case 7:
+				live -= q.RemoveFunc(func(_ shedding.Criticality, v int) bool { return v%(arg+2) == 0 })
+			}
+			if n := q.Len(); n < 0 || n > live {
+				t.Fatalf("after op %d: Len() = %d, want between 0 and %d", i, n, live)
+			}
+		}
+
+		q.Close()
+		for _, cancel := range cancels {
+			cancel()
+		}
+		// Sheds started by cancellations may still be finishing
+		deadline := time.Now().Add(10 * time.Second)
+		for i, n := range calls {
+			for n.Load() == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := n.Load(); got != 1 {
+				t.Errorf("cancel for element %d called %d times, want once", i, got)
+			}
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package queue
+
+import (
+	"math"
+	"time"
+)
+
+// histBuckets covers waits up to 2^40µs, about twelve days, before the last
+// bucket starts collecting everything longer
+const histBuckets = 4*40 + 1
+
+// waitHistogram counts wait times in logarithmic buckets, four to each
+// doubling from a microsecond, so that percentiles are accurate to within
+// about 10% for a fixed cost per sample. Bucket 0 holds waits of up to a
+// microsecond, and bucket i > 0 those from 2^((i-1)/4)µs to 2^(i/4)µs.
+type waitHistogram struct {
+	counts [histBuckets]uint64
+	total  uint64
+}
+
+func (h *waitHistogram) add(d time.Duration) {
+	i := 0
+	if d > time.Microsecond {
+		i = min(int(4*math.Log2(float64(d)/float64(time.Microsecond)))+1, histBuckets-1)
+	}
+	h.counts[i]++
+	h.total++
+}
+
+// percentile returns the p'th percentile, by the nearest-rank method, as the
+// geometric middle of its bucket. Waits in bucket 0 are reported as zero.
+func (h *waitHistogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(max(math.Ceil(p*float64(h.total)), 1))
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		if n < rank {
+			continue
+		}
+		if i == 0 {
+			return 0
+		}
+		return time.Duration(float64(time.Microsecond) * math.Exp2((float64(i)-0.5)/4))
+	}
+	return 0
+}
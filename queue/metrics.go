@@ -0,0 +1,40 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/asuffield/shedding"
+)
+
+// Metrics receives queue events, for export to a monitoring system; see the
+// promqueue package for a Prometheus implementation. Its methods are called
+// with the queue lock held, so they must be cheap and must not call back into
+// the queue.
+type Metrics interface {
+	// Inserted is called for every insert, including those which are then
+	// immediately shed
+	Inserted(crit shedding.Criticality)
+	// Removed is called when an element is dequeued, with the time it spent in
+	// the queue
+	Removed(crit shedding.Criticality, waited time.Duration)
+	// Shed is called for every element that is shed
+	Shed(crit shedding.Criticality, reason ShedReason)
+}
+
+// Tracer starts a span covering an element's time in the queue; see the
+// otelqueue package for an OpenTelemetry implementation. Like Metrics, it is
+// called with the queue lock held.
+type Tracer interface {
+	// Start is called when an element is inserted, with the context it was
+	// inserted with
+	Start(ctx context.Context, crit shedding.Criticality) Span
+}
+
+// Span is the in-queue span of a single element. Exactly one of its methods
+// is called, ending the span. Elements discarded by Close are reported as
+// ShedCancelled.
+type Span interface {
+	Dequeued()
+	Shed(reason ShedReason)
+}
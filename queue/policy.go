@@ -0,0 +1,166 @@
+package queue
+
+import (
+	"sort"
+	"time"
+
+	"github.com/asuffield/shedding"
+)
+
+// ElementView is what a ShedPolicy sees of a queued element
+type ElementView struct {
+	Criticality shedding.Criticality
+	// Priority is Criticality adjusted by Config.AgingAfter and
+	// Config.NoDeadlinePolicy; it is what the default policy compares
+	Priority shedding.Criticality
+	Deadline time.Time // less Config.ProcessingReserve; zero if the element has no deadline
+	Enqueued time.Time
+	Weight   float64
+}
+
+// ShedPolicy decides which elements to shed, after those whose context is
+// done have been removed. It is called with the queue lock held, whenever the
+// queue sheds.
+type ShedPolicy interface {
+	// Shed returns the indexes into elements of those to keep, in ascending
+	// order; the rest are shed with ShedDeadline. elements are in dequeue
+	// order, and only valid until Shed returns. expectedWait is the time to
+	// allow per unit of weight, adjusted by SafetyFactor and SafetyMargin, or
+	// zero until the estimate is ready.
+	Shed(elements []ElementView, now time.Time, expectedWait time.Duration) (keep []int)
+}
+
+// DefaultPolicy sheds elements which are not expected to be dequeued before
+// their deadline. If shedding less critical elements ahead of one would let it
+// meet its deadline, those are shed instead, least critical and most recently
+// inserted first. Nothing is shed until the wait estimate is ready.
+type DefaultPolicy struct {
+	// Less reports whether criticality a is less critical than b, as
+	// Config.Less. Defaults to a < b.
+	Less func(a, b shedding.Criticality) bool
+}
+
+func (p DefaultPolicy) Shed(elements []ElementView, now time.Time, expectedWait time.Duration) []int {
+	keep, _ := p.shed(elements, now, expectedWait, &policyScratch{})
+	return keep
+}
+
+func (p DefaultPolicy) less(a, b shedding.Criticality) bool {
+	if p.Less != nil {
+		return p.Less(a, b)
+	}
+	return a < b
+}
+
+// policyScratch holds DefaultPolicy's working storage, and the queue's own for
+// applying its result, so that a queue can reuse it between passes. The
+// result of shed is only valid until the next pass.
+type policyScratch struct {
+	tiers       []tier // kept entries of each priority so far, least critical first
+	keep        []bool
+	keepIndexes []int // the result
+
+	// For shedLocked, indexed by position in q.l
+	kept      []bool      // whether the policy kept each element
+	projected []time.Time // when each shed element would have been dequeued
+}
+
+type tier struct {
+	crit shedding.Criticality
+	kept []int // indexes into elements
+}
+
+// tier returns the kept entries of priority crit, adding it if necessary.
+// There are only a handful of distinct priorities in practice, so this reuses
+// the storage from previous passes rather than using a map.
+func (s *policyScratch) tier(crit shedding.Criticality, less func(a, b shedding.Criticality) bool) *tier {
+	n := sort.Search(len(s.tiers), func(j int) bool { return !less(s.tiers[j].crit, crit) })
+	if n < len(s.tiers) && !less(crit, s.tiers[n].crit) {
+		return &s.tiers[n]
+	}
+	if len(s.tiers) < cap(s.tiers) {
+		s.tiers = s.tiers[:len(s.tiers)+1]
+	} else {
+		s.tiers = append(s.tiers, tier{})
+	}
+	// Shift the later tiers up, reusing the storage left at the end
+	spare := s.tiers[len(s.tiers)-1].kept
+	copy(s.tiers[n+1:], s.tiers[n:])
+	s.tiers[n] = tier{crit: crit, kept: spare[:0]}
+	return &s.tiers[n]
+}
+
+// shed implements Shed, and also returns how many elements were kept by
+// shedding less critical ones ahead of them
+func (p DefaultPolicy) shed(elements []ElementView, now time.Time, wait time.Duration, s *policyScratch) (result []int, saved int) {
+	if wait == 0 {
+		// No estimate yet, so we can't tell what will miss its deadline
+		result = make([]int, len(elements))
+		for i := range result {
+			result[i] = i
+		}
+		return result, 0
+	}
+
+	// If a higher-criticality entry would be doable by shedding less critical
+	// entries ahead of it, then we need to shed before that point. We use a
+	// multiple-list approach to make backtracking easy.
+	s.tiers = s.tiers[:0]
+	keep := append(s.keep[:0], make([]bool, len(elements))...)
+	s.keep = keep
+	kept := 0.0 // total weight of the entries kept so far
+
+	for i, e := range elements {
+		crit := e.Priority
+		if !e.Deadline.IsZero() {
+			// How much weight can be dequeued by the deadline, including this one
+			slots := float64(e.Deadline.Sub(now)) / float64(wait)
+			if need := kept + e.Weight - slots; need > 0 {
+				// This item is not expected to be done before its deadline. If
+				// there are enough less critical entries ahead of it then shed
+				// those instead, lowest criticality and most recent first;
+				// otherwise shed it immediately.
+				avail := 0.0
+				for _, t := range s.tiers {
+					if !p.less(t.crit, crit) {
+						break
+					}
+					for _, j := range t.kept {
+						avail += elements[j].Weight
+					}
+				}
+				if slots < e.Weight || avail < need {
+					continue
+				}
+				for k := range s.tiers {
+					t := &s.tiers[k]
+					for need > 0 && len(t.kept) > 0 {
+						j := t.kept[len(t.kept)-1]
+						t.kept = t.kept[:len(t.kept)-1]
+						keep[j] = false
+						kept -= elements[j].Weight
+						need -= elements[j].Weight
+					}
+					if need <= 0 {
+						break
+					}
+				}
+				saved++
+			}
+		}
+
+		keep[i] = true
+		kept += e.Weight
+		t := s.tier(crit, p.less)
+		t.kept = append(t.kept, i)
+	}
+
+	result = s.keepIndexes[:0]
+	for i, k := range keep {
+		if k {
+			result = append(result, i)
+		}
+	}
+	s.keepIndexes = result
+	return result, saved
+}
@@ -0,0 +1,170 @@
+package queue
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/asuffield/shedding"
+)
+
+func TestDefaultPolicySheds(t *testing.T) {
+	now := time.Now()
+	views := []ElementView{
+		{Criticality: shedding.Critical, Priority: shedding.Critical, Deadline: now.Add(time.Hour), Weight: 1},
+		{Criticality: shedding.Critical, Priority: shedding.Critical, Deadline: now.Add(1500 * time.Millisecond), Weight: 1},
+		{Criticality: shedding.Critical, Priority: shedding.Critical, Weight: 1},
+	}
+	// The second can't be dequeued in time, and there's nothing less critical
+	// ahead of it to shed instead
+	if keep := (DefaultPolicy{}).Shed(views, now, time.Second); !slices.Equal(keep, []int{0, 2}) {
+		t.Errorf("Shed() kept %v, want [0 2]", keep)
+	}
+	if keep := (DefaultPolicy{}).Shed(views, now, 0); !slices.Equal(keep, []int{0, 1, 2}) {
+		t.Errorf("Shed() without an estimate kept %v, want everything", keep)
+	}
+}
+
+func TestDefaultPolicySaves(t *testing.T) {
+	now := time.Now()
+	views := []ElementView{
+		{Criticality: shedding.Sheddable, Priority: shedding.Sheddable, Deadline: now.Add(time.Hour), Weight: 1},
+		{Criticality: shedding.Sheddable, Priority: shedding.Sheddable, Deadline: now.Add(time.Hour), Weight: 1},
+		{Criticality: shedding.Critical, Priority: shedding.Critical, Deadline: now.Add(2500 * time.Millisecond), Weight: 1},
+	}
+	// Shedding the more recent of the sheddable elements lets the critical one
+	// be dequeued in time
+	if keep := (DefaultPolicy{}).Shed(views, now, time.Second); !slices.Equal(keep, []int{0, 2}) {
+		t.Errorf("Shed() kept %v, want [0 2]", keep)
+	}
+}
+
+// threshold is a ShedPolicy which sheds everything less critical than min
+type threshold struct {
+	min shedding.Criticality
+}
+
+func (p threshold) Shed(elements []ElementView, _ time.Time, _ time.Duration) []int {
+	var keep []int
+	for i, e := range elements {
+		if e.Criticality >= p.min {
+			keep = append(keep, i)
+		}
+	}
+	return keep
+}
+
+func TestCustomPolicy(t *testing.T) {
+	q := &Queue[string]{}
+	q.Config.ShedPolicy = threshold{shedding.Critical}
+	var shed []ShedReason
+	q.Config.OnShed = func(_ shedding.Criticality, _ string, reason ShedReason) {
+		shed = append(shed, reason)
+	}
+	for _, crit := range shedding.AllCriticalities {
+		q.Insert(context.Background(), crit, crit.String(), nil)
+	}
+	if got, want := removeAll(q), []string{"CRITICAL", "CRITICAL_PLUS"}; !slices.Equal(got, want) {
+		t.Errorf("dequeued %q, want %q", got, want)
+	}
+	if !slices.Equal(shed, []ShedReason{ShedDeadline, ShedDeadline}) {
+		t.Errorf("shed with reasons %v, want two for deadline", shed)
+	}
+}
+
+// BenchmarkNoShed measures a shed pass over a healthy queue of 100 elements,
+// where nothing needs shedding, with the fast path that skips the
+// policy and with DefaultPolicy set explicitly, which always runs it
+func BenchmarkNoShed(b *testing.B) {
+	for _, tc := range []struct {
+		name   string
+		policy ShedPolicy
+	}{
+		{"fast", nil},
+		{"full", DefaultPolicy{}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			q, mc := newTimedQueue(b, time.Microsecond)
+			q.Config.ShedPolicy = tc.policy
+			ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Hour))
+			defer cancel()
+			for i := 0; i < 100; i++ {
+				q.Insert(ctx, shedding.Sheddable, "a", nil)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				q.mux.Lock()
+				q.shedLocked()
+				q.mux.Unlock()
+			}
+			if n := q.Len(); n != 100 {
+				b.Fatalf("Len() = %d, want 100 with nothing shed", n)
+			}
+		})
+	}
+}
+
+// BenchmarkDefaultPolicy measures a shed pass over 1000 elements of mixed
+// criticality, with the working storage reused between passes, as a queue
+// does, and allocated afresh each time
+func BenchmarkDefaultPolicy(b *testing.B) {
+	now := time.Now()
+	views := make([]ElementView, 1000)
+	for i := range views {
+		crit := shedding.AllCriticalities[i%len(shedding.AllCriticalities)]
+		views[i] = ElementView{Criticality: crit, Priority: crit, Deadline: now.Add(time.Duration(i) * 2 * time.Millisecond), Weight: 1}
+	}
+
+	b.Run("reused", func(b *testing.B) {
+		b.ReportAllocs()
+		var scratch policyScratch
+		for i := 0; i < b.N; i++ {
+			(DefaultPolicy{}).shed(views, now, time.Millisecond, &scratch)
+		}
+	})
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			(DefaultPolicy{}).Shed(views, now, time.Millisecond)
+		}
+	})
+}
+
+// keepAll is a ShedPolicy which keeps everything, without allocating
+type keepAll []int
+
+func (p keepAll) Shed(elements []ElementView, _ time.Time, _ time.Duration) []int {
+	return p[:len(elements)]
+}
+
+func TestShedPassReusesStorage(t *testing.T) {
+	for _, logged := range []bool{false, true} {
+		q, mc := newTimedQueue(t, time.Microsecond)
+		keep := make(keepAll, 100)
+		for i := range keep {
+			keep[i] = i
+		}
+		q.Config.ShedPolicy = keep
+		if logged {
+			q.Config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Hour))
+		defer cancel()
+		for _, crit := range slices.Repeat(shedding.AllCriticalities, 100/len(shedding.AllCriticalities)) {
+			q.Insert(ctx, crit, "a", nil)
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			q.mux.Lock()
+			q.shedLocked()
+			q.mux.Unlock()
+		})
+		if allocs != 0 {
+			t.Errorf("with Logger %v: shed pass made %v allocations, want none once its storage is reused", logged, allocs)
+		}
+	}
+}
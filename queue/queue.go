@@ -2,10 +2,95 @@ package queue
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"slices"
 	"time"
 	"github.com/asuffield/shedding"
 	"github.com/benbjohnson/clock"
-	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrClosed is returned by RemoveWait once the queue has been closed
+var ErrClosed = errors.New("queue closed")
+
+// ErrRejected is returned by InsertWait if the element was discarded on insert
+var ErrRejected = errors.New("element rejected")
+
+// ShedReason describes why an element was shed
+type ShedReason int
+
+const (
+	ShedCancelled ShedReason = iota // The element's context was already done
+	ShedDeadline // The element was not expected to be dequeued before its deadline, or was shed so a more critical one could be
+	ShedCapacity // The queue was full
+	ShedQuota // The element's criticality was over its quota
+	ShedProbability // The element was dropped at random by Config.DropProbability
+	ShedDuplicate // Another element with the same key was inserted by InsertKeyed
+)
+
+func (r ShedReason) String() string {
+	switch r {
+	case ShedCancelled:
+		return "cancelled"
+	case ShedDeadline:
+		return "deadline"
+	case ShedCapacity:
+		return "capacity"
+	case ShedQuota:
+		return "quota"
+	case ShedProbability:
+		return "probability"
+	case ShedDuplicate:
+		return "duplicate"
+	}
+	return fmt.Sprintf("ShedReason(%d)", int(r))
+}
+
+// Order is the order in which elements are dequeued
+type Order int
+
+const (
+	// OrderFIFO dequeues elements in the order they were inserted
+	OrderFIFO Order = iota
+	// OrderEDF dequeues the element with the earliest deadline first, across
+	// all criticalities, with elements that have no deadline last. Ties are
+	// broken in insertion order. Criticality still decides what is shed.
+	OrderEDF
+	// OrderLIFO dequeues the most critical element first, and the most
+	// recently inserted within each criticality, for workloads where only the
+	// freshest elements are worth serving. Aging does not affect the order.
+	OrderLIFO
+)
+
+// NoDeadlinePolicy is how elements without a deadline are shed
+type NoDeadlinePolicy int
+
+const (
+	// NoDeadlineNever never sheds elements without a deadline for being late,
+	// though they may still be shed so that more critical elements behind them
+	// meet their deadlines
+	NoDeadlineNever NoDeadlinePolicy = iota
+	// NoDeadlineLowest is NoDeadlineNever, but also treats elements without a
+	// deadline as less critical than any with one, regardless of their own
+	// criticality or age, so they are the first to be shed to save others and
+	// when the queue is full
+	NoDeadlineLowest
+	// NoDeadlineTTL gives elements without a deadline one of Config.DefaultTTL
+	// after they are inserted
+	NoDeadlineTTL
+)
+
+// The extreme priorities. Elements without a deadline get whichever is less
+// critical under NoDeadlineLowest, leaving room for custom criticalities.
+const (
+	minPriority = shedding.Criticality(math.MinInt32)
+	maxPriority = shedding.Criticality(math.MaxInt32)
 )
 
 type element[T any] struct {
@@ -14,150 +99,1731 @@ type element[T any] struct {
 	crit shedding.Criticality
 	v T
 	enqueued time.Time
+	span Span // nil unless Config.Tracer is set
+	weight float64 // processing cost relative to a normal element
+	until time.Time // deadline from InsertDeadline, if non-zero
+	done chan struct{} // identifies the element, for insert and InsertKeyed; nil in batches
+	unwatch func() // stops shedding when ctx is done; nil in batches
+	wouldShed bool // reported by DryRun
+	key string // from InsertKeyed, if non-empty
+	front bool // from Requeue: goes ahead of the elements it would otherwise follow
 }
 
-type Config struct {
+// deadline returns the deadline by which e must be dequeued, if it has one
+func (e element[T]) deadline() (time.Time, bool) {
+	at, ok := e.ctx.Deadline()
+	if !e.until.IsZero() && (!ok || e.until.Before(at)) {
+		return e.until, true
+	}
+	return at, ok
+}
+
+type Config[T any] struct {
 	Clock clock.Clock
 	TimingHistory int // Estimate the dequeue rate using this many recent data points
-	DiscardOutliers int // Remove this many values from the highest and lowest end of the range. Not recommended for value values of TimingHistory, because this requires a sort.
+	DiscardOutliers int // Remove this many values from the highest and lowest end of the range. Not recommended for value values of TimingHistory, because this requires a sort. Defaults to 1 if TimingHistory is also defaulted; set it negative to keep every value.
+	MinSamples int // Don't shed based on deadlines until this many data points have been collected. Defaults to, and may not exceed, TimingHistory.
+	MaxInterval time.Duration // If non-zero, dequeue intervals longer than this are discarded as bogus, e.g. after the clock jumps or the consumers stall.
+	// OutlierMAD, if non-zero, replaces DiscardOutliers with a more robust
+	// filter, which discards intervals more than OutlierMAD median absolute
+	// deviations from the median, however many there are. If most intervals are
+	// identical, everything else is discarded.
+	OutlierMAD float64
+	// AutoOutliers, if set, replaces DiscardOutliers with a number chosen
+	// from how noisy the timing history is. Nothing is discarded while the
+	// intervals' standard deviation is small next to their mean. As it grows,
+	// up to a tenth of the history is discarded from each end. OutlierMAD
+	// takes precedence.
+	AutoOutliers bool
+	Estimator Estimator // Statistic used to estimate the wait per item from the timing history
+	// Aggregate, if set, replaces Estimator. It is passed the timing history,
+	// sorted in ascending order and with outliers discarded, and returns the
+	// expected wait per item. It may modify the slice, which is a copy. It is
+	// called with the queue lock held after each dequeue, so it should be cheap.
+	Aggregate func(intervals []time.Duration) time.Duration
+	// MinExpectedWait, if non-zero, is a floor on the estimated wait per item,
+	// such as the known minimum latency downstream, so that a run of quick
+	// dequeues can't make the estimate dip below what elements really cost. It
+	// is applied to the estimate, not the samples, so an estimate above the
+	// floor is unaffected, and it does not apply during warmup.
+	MinExpectedWait time.Duration
+	Order Order // Dequeue order. Must not be changed once the queue is in use.
+
+	// Consumers is the number of goroutines removing elements concurrently,
+	// for ServiceTime. Defaults to 1.
+	Consumers int
+
+	// When projecting whether elements will meet their deadlines, each element
+	// ahead is assumed to take the expected wait multiplied by SafetyFactor,
+	// plus SafetyMargin, to allow for estimation error and processing time.
+	// SafetyFactor defaults to 1.
+	SafetyFactor float64
+	SafetyMargin time.Duration
+
+	// InFlightBias allows for the element the consumers are working on when
+	// projecting dequeue times. If the queue has gone longer than the expected
+	// wait without a dequeue while there were elements waiting, not counting
+	// time it spent empty, that element is overrunning, and is assumed to
+	// take as long again as it already has, so every projected dequeue is
+	// pushed back by the overrun. A ShedPolicy sees this as a later now.
+	InFlightBias bool
+
+	// ProcessingReserve is taken off every deadline when projecting whether
+	// elements will meet them, so that they are shed unless they can be
+	// dequeued with at least this long left to process them, rather than
+	// dequeued only to time out downstream. It does not affect when elements
+	// are shed for their deadline having passed.
+	ProcessingReserve time.Duration
+
+	// UseEWMA estimates the wait per item with an exponentially weighted moving
+	// average of dequeue intervals instead, which needs no history. Estimator,
+	// Aggregate and DiscardOutliers are ignored, and TimingHistory is only used
+	// as the default for MinSamples.
+	UseEWMA bool
+	EWMAAlpha float64 // Weight given to each new sample by UseEWMA. Defaults to 0.1.
+
+	// RejectLate makes inserts reject elements which could not be dequeued
+	// before their deadline, according to ProjectedWait, with ShedDeadline,
+	// rather than queuing them to be shed straight away. Insert then returns
+	// false for them.
+	RejectLate bool
+
+	// MaxLen, if non-zero, bounds the length of the queue. Inserting into a full
+	// queue sheds the least critical element, most recently inserted first,
+	// which may be the new one.
+	MaxLen int
+
+	// Quotas limits the number of live elements of each criticality. Inserts
+	// over quota are shed. Criticalities with no entry are unlimited.
+	Quotas map[shedding.Criticality]int
+
+	// AgingAfter, if non-zero, protects long-waiting elements from being shed in
+	// favour of more critical ones, and from being starved by them. An element
+	// is treated as one criticality level higher for each AgingAfter it has
+	// been queued, so once aged it ranks equal to genuinely more critical
+	// elements, and ahead of any that arrived after it. That applies to
+	// shedding, and with TierWeights to the dequeue order too, since an aged
+	// element takes its turn with the tier it ranks with. Without TierWeights,
+	// OrderFIFO and OrderEDF dequeue regardless of criticality, so aging has
+	// nothing to reorder, and OrderLIFO places elements by criticality once,
+	// on insert. Aging does not affect quotas.
+	AgingAfter time.Duration
+
+	// NoDeadlinePolicy decides how elements without a deadline are shed, with
+	// DefaultTTL for NoDeadlineTTL. DefaultTTL defaults to one minute.
+	NoDeadlinePolicy NoDeadlinePolicy
+	DefaultTTL time.Duration
+
+	// TierDeadline gives elements without a deadline of their own one of
+	// TierDeadline[crit] after they are inserted, for criticalities with an
+	// SLA but callers which don't set deadlines. It takes precedence over
+	// DefaultTTL; criticalities with no entry fall back to NoDeadlinePolicy.
+	// Elements with a deadline keep it, even if it is later.
+	TierDeadline map[shedding.Criticality]time.Duration
+
+	// TierWeights, if set, changes the dequeue order so that each criticality
+	// gets a share of dequeues in proportion to its weight, counting element
+	// weights, rather than strictly following Order; see Remove. Order still
+	// applies within each criticality, which is taken after aging by
+	// AgingAfter. Criticalities with no entry have weight 1. Which elements
+	// are shed is decided as usual, but with their dequeue times projected in
+	// the weighted order, assuming no more are inserted.
+	TierWeights map[shedding.Criticality]int
+
+	// ShedInterval, if non-zero, sheds periodically in the background, so that
+	// elements are shed even when the queue is idle. The background goroutine
+	// starts on the first insert, and is stopped by Close.
+	ShedInterval time.Duration
+
+	// OnShed, if set, is called for each element that is shed, after its cancel
+	// function. It is called without the queue lock held, so it may call back
+	// into the queue.
+	OnShed func(crit shedding.Criticality, v T, reason ShedReason)
+
+	// OnDequeue, if set, is called for each element removed from the queue,
+	// with how long it was queued. Like OnShed, it is called without the queue
+	// lock held.
+	OnDequeue func(crit shedding.Criticality, v T, waited time.Duration)
+
+	// OnDiscard, if set, is called for each element discarded by Clear,
+	// RemoveFunc or Close, which are neither shed nor dequeued. Like OnShed, it
+	// is called without the queue lock held.
+	OnDiscard func(crit shedding.Criticality, v T)
+
+	// Less reports whether criticality a is less critical than b, for schemes
+	// where higher values are less critical. Defaults to a < b, which is the
+	// order of the standard criticalities. It is used for every comparison of
+	// criticality: shedding, aging, OrderLIFO and TierWeights.
+	Less func(a, b shedding.Criticality) bool
+
+	// ShedPolicy decides which elements to shed. Defaults to DefaultPolicy,
+	// with Less.
+	ShedPolicy ShedPolicy
+
+	// DryRun stops the ShedPolicy, DropProbability and RejectLate from
+	// shedding anything, for trying out a configuration safely. Instead, each
+	// element they would shed is counted in Stats.WouldShed and reported to
+	// OnWouldShed, once, and stays queued.
+	// Elements whose context is done, and those over the MaxLen and Quotas
+	// limits, are still shed.
+	DryRun bool
+	// OnWouldShed is called like OnShed, for elements that DryRun kept
+	OnWouldShed func(crit shedding.Criticality, v T, reason ShedReason)
+
+	// OnOverloadStart and OnOverloadEnd, if set, are called when the queue
+	// starts shedding elements for their deadlines, and when it has since gone
+	// OverloadCooldown without doing so, so they don't flap on every borderline
+	// shed. Like OnShed, they are called without the queue lock held.
+	OnOverloadStart func()
+	OnOverloadEnd func()
+	OverloadCooldown time.Duration
+
+	// DropProbability, if set, drops inserts at random, so that less critical
+	// elements can be shed gradually as the queue comes under pressure rather
+	// than all at once. It returns the probability of dropping a new element,
+	// given its criticality and the pressure on it: its ProjectedWait as a
+	// fraction of the time until its deadline, so above 1 it would be late, or 0
+	// if it has no deadline or there is no estimate yet. Dropped elements are
+	// shed with ShedProbability.
+	DropProbability func(crit shedding.Criticality, pressure float64) float64
+	// Rand is the source of randomness for DropProbability. Defaults to a
+	// randomly seeded generator; set it to a seeded one for reproducibility.
+	Rand *rand.Rand
+
+	// DeadLetterSize, if non-zero, keeps the last DeadLetterSize shed
+	// elements, for DeadLetter
+	DeadLetterSize int
+
+	// ReplaceDuplicates makes InsertKeyed shed the queued element with the
+	// same key in favour of the new one, rather than the new one
+	ReplaceDuplicates bool
+
+	// OnStats, if set, is called with the queue's Stats after an operation
+	// on it, at most once every StatsInterval, which defaults to a second, for
+	// exporting gauges to metrics systems without a Metrics implementation.
+	// Combine it with ShedInterval to keep it called while the queue is idle.
+	// Like OnShed, it is called without the queue lock held.
+	OnStats func(QueueStats)
+	StatsInterval time.Duration
+
+	// Logger, if set, logs each shed at debug level, with the element's
+	// criticality, deadline and projected dequeue time, and the wait estimate.
+	// It is called without the queue lock held.
+	Logger *slog.Logger
+
+	// Metrics, if set, is told about every insert, removal and shed
+	Metrics Metrics
+	// Tracer, if set, starts a span for each inserted element
+	Tracer Tracer
 }
 
-func (c *Config) defaults() {
+func (c *Config[T]) defaults() {
 	if c.Clock == nil {
 		c.Clock = clock.New()
 	}
 	if c.TimingHistory == 0 {
+		// The default history is long enough to be worth trimming, unless
+		// that was configured too
 		c.TimingHistory = 100
-		c.DiscardOutliers = 1
+		if c.DiscardOutliers == 0 {
+			c.DiscardOutliers = 1
+		}
+	}
+	if c.Consumers <= 0 {
+		c.Consumers = 1
+	}
+	if c.SafetyFactor <= 0 {
+		c.SafetyFactor = 1
+	}
+	if c.SafetyMargin < 0 {
+		c.SafetyMargin = 0
+	}
+	if c.MinSamples <= 0 || c.MinSamples > c.TimingHistory {
+		c.MinSamples = c.TimingHistory
+	}
+	if c.NoDeadlinePolicy == NoDeadlineTTL && c.DefaultTTL <= 0 {
+		// Otherwise every element without a deadline would be shed at once
+		c.DefaultTTL = time.Minute
+	}
+	if c.StatsInterval <= 0 {
+		c.StatsInterval = time.Second
+	}
+	if c.EWMAAlpha <= 0 || c.EWMAAlpha > 1 {
+		c.EWMAAlpha = 0.1
+	}
+	// Always leave at least one sample to estimate from
+	if c.DiscardOutliers < 0 {
+		c.DiscardOutliers = 0
+	}
+	if limit := (c.TimingHistory - 1) / 2; c.DiscardOutliers > limit {
+		c.DiscardOutliers = limit
 	}
 }
 
+// inherit fills in the Clock, Rand, Logger, Metrics, Tracer and callbacks
+// that c leaves nil from old, for Reconfigure
+func (c *Config[T]) inherit(old *Config[T]) {
+	if c.Clock == nil {
+		c.Clock = old.Clock
+	}
+	if c.Rand == nil {
+		c.Rand = old.Rand
+	}
+	if c.Logger == nil {
+		c.Logger = old.Logger
+	}
+	if c.Metrics == nil {
+		c.Metrics = old.Metrics
+	}
+	if c.Tracer == nil {
+		c.Tracer = old.Tracer
+	}
+	if c.OnShed == nil {
+		c.OnShed = old.OnShed
+	}
+	if c.OnDequeue == nil {
+		c.OnDequeue = old.OnDequeue
+	}
+	if c.OnDiscard == nil {
+		c.OnDiscard = old.OnDiscard
+	}
+	if c.OnWouldShed == nil {
+		c.OnWouldShed = old.OnWouldShed
+	}
+	if c.OnOverloadStart == nil {
+		c.OnOverloadStart = old.OnOverloadStart
+	}
+	if c.OnOverloadEnd == nil {
+		c.OnOverloadEnd = old.OnOverloadEnd
+	}
+	if c.OnStats == nil {
+		c.OnStats = old.OnStats
+	}
+}
+
+// Reconfigure replaces the queue's configuration, which otherwise must not
+// be changed once the queue is in use. Defaults are applied to c as usual, and
+// the timing history is kept, discarding the oldest samples if TimingHistory
+// has shrunk. Order may only be changed while the queue is empty. Elements
+// already queued are shed under the new configuration from the next shed.
+//
+// The Clock, Rand, Logger, Metrics, Tracer and callbacks are kept where c
+// leaves them nil, so Reconfigure doesn't lose hooks installed at runtime,
+// such as by shedhttp, shedgrpc or promqueue. To remove a callback, set it to
+// a function which does nothing.
+func (q *Queue[T]) Reconfigure(c Config[T]) error {
+	q.mux.Lock()
+	defer q.unlock()
+
+	if c.Order != q.Config.Order && q.l.len() > 0 {
+		return ErrReconfigureOrder
+	}
+	c.inherit(&q.Config)
+	c.defaults()
+	restartTicker := q.ticker != nil && c.ShedInterval != q.Config.ShedInterval
+	q.Config = c
+	if restartTicker {
+		q.stopTicking()
+		q.startTicker()
+	}
+
+	for q.recentDequeue.len() > c.TimingHistory {
+		q.recentDequeue.popFront()
+	}
+	// Force the estimate to be recomputed under the new configuration
+	q.timingStale = true
+	return nil
+}
+
+// Shedder is the core of Queue, for code which should work with other
+// queue implementations or test doubles
+type Shedder[T any] interface {
+	// Insert adds v, returning false if it was discarded. cancel, which may be
+	// nil, is called when v is removed or shed.
+	Insert(ctx context.Context, crit shedding.Criticality, v T, cancel context.CancelFunc) bool
+	// Remove dequeues the next element, returning false if there is none
+	Remove() (T, bool)
+	Len() int
+}
+
+var _ Shedder[int] = (*Queue[int])(nil)
+
+// ErrReconfigureOrder is returned by Reconfigure for a change of Order while
+// the queue is not empty
+var ErrReconfigureOrder = errors.New("can't change the order of a non-empty queue")
+
 type Queue[T any] struct {
-	Config Config
+	Config Config[T]
 
-	l []element[T]
+	mux sync.Mutex // guards everything below, and Config
+	// l holds the queued elements in dequeue order, or with TierWeights, in
+	// the order of their turns within each tier (see dequeueOrder). This is
+	// deliberately not a heap keyed on criticality and deadline: every shed
+	// pass walks all the elements in dequeue order to project their waits, and
+	// the backtracking in DefaultPolicy depends on that order, so a heap would
+	// have to be sorted on every pass, making shedding more expensive rather
+	// than less. BenchmarkStorage compares the two: a heap removes from the
+	// middle in O(log n) where ring shifts, but that only happens outside the
+	// shed pass, which filters in a single walk; and sorting a heap for the
+	// walk costs far more than the walk.
+	l ring[element[T]]
 	lastDequeue time.Time
-	recentDequeue []time.Duration
+	filledAt time.Time // when the queue last became non-empty
+	recentDequeue ring[time.Duration] // at most TimingHistory recent dequeue intervals, oldest first
+	ewma float64 // moving average of dequeue intervals in nanoseconds, with UseEWMA
+	ewmaSamples int // number of samples in ewma
 	expectedWait time.Duration // expected wait time per item in the queue
-	expectedWaitAt time.Time // time when expectedWait was last computed
+	timingStale bool // set when the history or configuration has changed since expectedWait was computed
+	closed bool
+	draining bool // set by Shutdown; inserts are rejected
+	drained chan struct{} // closed by unlock once the queue is empty, for Shutdown and WaitUntilEmpty
+	space chan struct{} // closed by unlock once the queue is below MaxLen, for InsertWait
+	nInserted, nRemoved, nShed uint64 // counters for Stats
+	nSaved uint64 // number of elements kept by shedding less critical ones ahead
+	nShedBy map[ShedReason]uint64 // nShed broken down by reason
+	nWouldShed uint64 // elements DryRun would have shed
+	waits waitHistogram // how long each dequeued element was queued
+	deadLetter ring[T] // the last DeadLetterSize elements shed
+	views []ElementView // storage for the ShedPolicy input, reused by each pass
+	scratch policyScratch // storage for DefaultPolicy, reused by each pass
+	wake chan struct{} // closed to wake RemoveWait callers when an element is inserted or the queue is closed
+	ticker *clock.Ticker // for ShedInterval
+	stopTicker chan struct{}
+	cancels []context.CancelFunc // cancel functions to be called by unlock, once mux is released
+	dropped []shedRecord[T] // elements shed while holding mux, to be reported by unlock
+	dequeued []dequeueRecord[T] // elements removed while holding mux, to be reported by unlock
+	notify []func() // other callbacks to be called by unlock
+	overloaded bool // whether OnOverloadStart has been called without OnOverloadEnd
+	lastOverload time.Time // when an element was last shed for its deadline
+	deficit map[shedding.Criticality]float64 // round robin state for TierWeights
+	tier shedding.Criticality // tier currently being served, if tierActive
+	tierActive bool
+	lastStats time.Time // when OnStats was last called
+	keys map[string]keyed // the queued element with each InsertKeyed key
 }
 
-type Criticality int
+type shedRecord[T any] struct {
+	e element[T]
+	reason ShedReason
+}
+
+type dequeueRecord[T any] struct {
+	e element[T]
+	waited time.Duration
+}
+
+// Insert adds v to the tail of the queue. cancel will be called when the element
+// is removed or shed, and may be nil. Inserting into a closed or shutting down
+// queue calls cancel immediately and discards v.
+// Insert returns false if v was discarded, because the queue is closed, full, or
+// v's criticality is over quota. It also sheds before returning, so if v was
+// shed by that, e.g. because ctx is already done, it is gone from the queue
+// once Insert returns, though Insert still returns true; see TryInsert.
+func (q *Queue[T]) Insert(ctx context.Context, crit shedding.Criticality, v T, cancel context.CancelFunc) bool {
+	return q.insert(element[T]{ctx: ctx, cancel: cancel, crit: crit, v: v, weight: 1}, false)
+}
+
+// TryInsert is Insert, but returns false if v was shed by the shed before
+// returning too: because ctx is already done, v is not expected to be
+// dequeued before its deadline, or it was otherwise discarded as by Insert.
+func (q *Queue[T]) TryInsert(ctx context.Context, crit shedding.Criticality, v T, cancel context.CancelFunc) bool {
+	return q.insert(element[T]{ctx: ctx, cancel: cancel, crit: crit, v: v, weight: 1}, true)
+}
+
+// InsertWeighted is Insert, for an element whose processing cost is weight
+// times that of a normal element. Heavier elements delay those behind them
+// more in the deadline projection, and the wait estimate is kept per unit of
+// weight. Weights which are not positive are treated as 1.
+func (q *Queue[T]) InsertWeighted(ctx context.Context, crit shedding.Criticality, v T, weight float64, cancel context.CancelFunc) bool {
+	if weight <= 0 {
+		weight = 1
+	}
+	return q.insert(element[T]{ctx: ctx, cancel: cancel, crit: crit, v: v, weight: weight}, false)
+}
+
+// InsertDeadline is Insert, with a deadline for shedding which may differ from
+// ctx's deadline; whichever is earlier applies. ctx being done still sheds the
+// element.
+func (q *Queue[T]) InsertDeadline(ctx context.Context, crit shedding.Criticality, v T, deadline time.Time, cancel context.CancelFunc) bool {
+	return q.insert(element[T]{ctx: ctx, cancel: cancel, crit: crit, v: v, weight: 1, until: deadline}, false)
+}
+
+// InsertKeyed is Insert, for an element which duplicates any other queued with
+// the same key, such as a retry of a task. If a live element with that key is
+// already queued, the new one is shed with ShedDuplicate and InsertKeyed
+// returns false; or with ReplaceDuplicates, the old one is shed instead. The
+// old one is shed before the new one is admitted, so it doesn't count against
+// MaxLen, Quotas or the wait estimate for it; if the new one is then rejected
+// for another reason, neither remains queued. The new one takes its own place
+// in the queue, as Insert would give it, not that of the one it replaced. An
+// empty key is not deduplicated.
+func (q *Queue[T]) InsertKeyed(ctx context.Context, crit shedding.Criticality, key string, v T, cancel context.CancelFunc) bool {
+	return q.insert(element[T]{ctx: ctx, cancel: cancel, crit: crit, v: v, weight: 1, key: key}, false)
+}
 
-func (q *Queue[T]) Insert(ctx context.Context, crit shedding.Criticality, v T, cancel context.CancelFunc) {
+// Requeue puts back an element which was dequeued but could not be processed
+// yet, e.g. after a transient failure downstream, so that it is dequeued
+// ahead of the elements it would otherwise follow: next, with OrderFIFO;
+// before the others of its criticality with OrderLIFO; and before others with
+// the same deadline with OrderEDF. ctx should be the context v was inserted
+// with, as returned by RemoveCtx, so that its original deadline still
+// applies; the element is otherwise treated as newly inserted, and may be
+// shed as by Insert.
+func (q *Queue[T]) Requeue(ctx context.Context, crit shedding.Criticality, v T, cancel context.CancelFunc) bool {
+	return q.insert(element[T]{ctx: ctx, cancel: cancel, crit: crit, v: v, weight: 1, front: true}, false)
+}
+
+// insert implements Insert for a new element, shedding before returning in
+// case it should be discarded. If sync is set, it reports whether e survived
+// that.
+func (q *Queue[T]) insert(e element[T], sync bool) bool {
+	done := q.track(&e)
+
+	q.mux.Lock()
 	q.Config.defaults()
+	if q.closed || q.draining {
+		q.mux.Unlock()
+		e.cancel()
+		return false
+	}
+	ok := q.add(e)
+	if ok {
+		q.shedLocked()
+	}
+	if ok && sync {
+		for _, d := range q.dropped {
+			if d.e.done == done {
+				ok = false
+			}
+		}
+	}
+	q.unlock()
+	return ok
+}
 
-	q.l = append(q.l, element[T]{ctx, cancel, crit, v, q.Config.Clock.Now()})
-	go func() {
-		// Shed immediately in case this new element should be discarded
-		q.shed()
+// InsertWait is Insert, but if the queue is at MaxLen, it waits for room
+// rather than shedding to make some, giving the producer backpressure. It
+// returns ErrClosed if the queue is closed or shutting down, or ctx.Err() if
+// ctx is done while waiting; in either case cancel is called and v discarded.
+// Once there is room, v is inserted as by Insert, so it may still be rejected
+// for its quota or other limits, returning ErrRejected. Inserts by Insert, and
+// so shedding for capacity, go ahead as usual while it waits.
+func (q *Queue[T]) InsertWait(ctx context.Context, crit shedding.Criticality, v T, cancel context.CancelFunc) error {
+	e := element[T]{ctx: ctx, cancel: cancel, crit: crit, v: v, weight: 1}
+	q.track(&e)
 
-		// Wait for the context to be cancelled
-		<-ctx.Done()
-		// Shed to remove cancelled items from the queue
-		q.shed()
-	}()
+	q.mux.Lock()
+	q.Config.defaults()
+	for {
+		if q.closed || q.draining {
+			q.unlock()
+			e.cancel()
+			return ErrClosed
+		}
+		if !q.full() {
+			break
+		}
+		// Clear out anything that's already dead before waiting
+		q.shedLocked()
+		if !q.full() {
+			break
+		}
+		if q.space == nil {
+			q.space = make(chan struct{})
+		}
+		space := q.space
+		q.unlock()
+
+		select {
+		case <-space:
+		case <-ctx.Done():
+			e.cancel()
+			return ctx.Err()
+		}
+		q.mux.Lock()
+	}
+	ok := q.add(e)
+	if ok {
+		q.shedLocked()
+	}
+	q.unlock()
+	if !ok {
+		return ErrRejected
+	}
+	return nil
+}
+
+// full reports whether the queue is at MaxLen. Must be called with q.mux held.
+func (q *Queue[T]) full() bool {
+	return q.Config.MaxLen > 0 && q.l.len() >= q.Config.MaxLen
+}
+
+// track arranges for the queue to shed when e's context is done, so that e is
+// removed promptly, and wraps e's cancel function so that it also stops that.
+// The queue calls it exactly once, when e leaves. It returns e.done.
+//
+// This uses context.AfterFunc rather than a goroutine per element, so that a
+// deep queue doesn't leave a goroutine parked on every context: for contexts
+// derived from the standard library's, the callback is only registered with
+// the context, and runs on a goroutine of its own once it is done.
+func (q *Queue[T]) track(e *element[T]) chan struct{} {
+	done := make(chan struct{})
+	stop := context.AfterFunc(e.ctx, q.shed)
+	unwatch := func() { stop() }
+	cancel := e.cancel
+	e.done, e.unwatch = done, unwatch
+	e.cancel = func() {
+		unwatch()
+		if cancel != nil {
+			cancel()
+		}
+	}
+	return done
 }
 
-func (q *Queue[T]) Remove() T {
+// InsertBatch inserts each of vs as Insert would, with a single lock
+// acquisition and shed pass, watching ctx once for the whole batch. cancel is
+// called once every element of the batch has been removed or shed. It returns
+// the number of elements that were not discarded.
+func (q *Queue[T]) InsertBatch(ctx context.Context, crit shedding.Criticality, vs []T, cancel context.CancelFunc) int {
+	stop := context.AfterFunc(ctx, q.shed)
+	q.mux.Lock()
 	q.Config.defaults()
-	q.shed()
+	if q.closed || q.draining || len(vs) == 0 {
+		q.mux.Unlock()
+		stop()
+		if cancel != nil {
+			cancel()
+		}
+		return 0
+	}
+	var remaining atomic.Int64
+	remaining.Store(int64(len(vs)))
+	release := func() {
+		if remaining.Add(-1) == 0 {
+			stop()
+			if cancel != nil {
+				cancel()
+			}
+		}
+	}
+	n := 0
+	for _, v := range vs {
+		if q.add(element[T]{ctx: ctx, cancel: release, crit: crit, v: v, weight: 1}) {
+			n++
+		}
+	}
+	if n > 0 {
+		q.shedLocked()
+	}
+	q.unlock()
+	return n
+}
 
-	var result T
-	if len(q.l) == 0 {
-		return result
+// add adds a new element to the queue, unless it is shed by the quota or
+// capacity limits. Must be called with q.mux held.
+func (q *Queue[T]) add(e element[T]) bool {
+	q.startTicker()
+	e.enqueued = q.Config.Clock.Now()
+	if _, ok := e.deadline(); !ok {
+		if d, ok := q.Config.TierDeadline[e.crit]; ok && d > 0 {
+			e.until = e.enqueued.Add(d)
+		} else if q.Config.NoDeadlinePolicy == NoDeadlineTTL {
+			e.until = e.enqueued.Add(q.Config.DefaultTTL)
+		}
+	}
+	if q.Config.Tracer != nil {
+		e.span = q.Config.Tracer.Start(e.ctx, e.crit)
+	}
+	q.nInserted++
+	if q.Config.Metrics != nil {
+		q.Config.Metrics.Inserted(e.crit)
+	}
+	if e.key != "" && q.duplicate(e.key) {
+		if !q.Config.ReplaceDuplicates {
+			q.drop(e, ShedDuplicate)
+			return false
+		}
+		q.replace(e.key)
+	}
+	if !q.withinQuota(e) {
+		q.drop(e, ShedQuota)
+		return false
+	}
+	unlucky := q.Config.DropProbability != nil && q.dropRandomly(e)
+	if unlucky && !q.Config.DryRun {
+		q.drop(e, ShedProbability)
+		return false
+	}
+	if !q.makeSpace(e) {
+		q.drop(e, ShedCapacity)
+		return false
+	}
+	late := q.Config.RejectLate && q.late(e)
+	if late && !q.Config.DryRun {
+		q.dropProjected(e, ShedDeadline, e.enqueued.Add(q.projectedWait(q.priority(e, e.enqueued), e.weight, e.enqueued)))
+		return false
+	}
+	if unlucky {
+		q.wouldShed(&e, ShedProbability)
+	} else if late {
+		q.wouldShed(&e, ShedDeadline)
+	}
+	if e.key != "" {
+		if q.keys == nil {
+			q.keys = map[string]keyed{}
+		}
+		q.keys[e.key] = keyed{e.ctx, e.done}
+	}
+	q.enqueue(e)
+	q.broadcast()
+	return true
+}
+
+// keyed identifies the queued element inserted with a key
+type keyed struct {
+	ctx  context.Context
+	done chan struct{}
+}
+
+// duplicate reports whether a live element inserted with key is queued. Must
+// be called with q.mux held.
+func (q *Queue[T]) duplicate(key string) bool {
+	k, ok := q.keys[key]
+	// One whose context is done is about to be shed anyway, so it doesn't count
+	return ok && k.ctx.Err() == nil
+}
+
+// replace sheds the element inserted with key. Must be called with q.mux held.
+func (q *Queue[T]) replace(key string) {
+	done := q.keys[key].done
+	for i, e := range q.l.all() {
+		if e.done == done {
+			q.drop(e, ShedDuplicate)
+			q.l.removeAt(i)
+			return
+		}
+	}
+}
+
+// forget removes e from q.keys, as it leaves the queue. Must be called with
+// q.mux held.
+func (q *Queue[T]) forget(e element[T]) {
+	if e.key != "" && e.done != nil && q.keys[e.key].done == e.done {
+		delete(q.keys, e.key)
+	}
+}
+
+// wouldShed counts e as shed for reason, under DryRun, and reports it to
+// OnWouldShed. Only the first time is counted, though every pass may decide to
+// shed it again. Must be called with q.mux held.
+func (q *Queue[T]) wouldShed(e *element[T], reason ShedReason) {
+	if e.wouldShed {
+		return
+	}
+	e.wouldShed = true
+	q.nWouldShed++
+	if f := q.Config.OnWouldShed; f != nil {
+		crit, v := e.crit, e.v
+		q.notify = append(q.notify, func() { f(crit, v, reason) })
+	}
+}
+
+// dropRandomly decides whether to drop e according to DropProbability. Must be
+// called with q.mux held.
+func (q *Queue[T]) dropRandomly(e element[T]) bool {
+	pressure := 0.0
+	if at, ok := q.dequeueBy(e); ok {
+		q.updateTiming()
+		if wait := q.projectedWait(q.priority(e, e.enqueued), e.weight, e.enqueued); wait > 0 {
+			pressure = float64(wait) / float64(max(at.Sub(e.enqueued), 1))
+		}
+	}
+	p := q.Config.DropProbability(e.crit, pressure)
+	if p <= 0 {
+		return false
+	}
+	if q.Config.Rand == nil {
+		q.Config.Rand = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+	return q.Config.Rand.Float64() < p
+}
+
+// late reports whether e cannot meet its deadline even if every less critical
+// element ahead of it were shed. Must be called with q.mux held.
+func (q *Queue[T]) late(e element[T]) bool {
+	at, ok := q.dequeueBy(e)
+	if !ok {
+		return false
+	}
+	q.updateTiming()
+	wait := q.projectedWait(q.priority(e, e.enqueued), e.weight, e.enqueued)
+	return wait > 0 && e.enqueued.Add(wait).After(at)
+}
+
+// startTicker starts shedding every ShedInterval, if configured and not
+// already started. Must be called with q.mux held.
+func (q *Queue[T]) startTicker() {
+	if q.Config.ShedInterval <= 0 || q.ticker != nil {
+		return
+	}
+	ticker := q.Config.Clock.Ticker(q.Config.ShedInterval)
+	stop := make(chan struct{})
+	q.ticker, q.stopTicker = ticker, stop
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				q.shed()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopTicking stops the ShedInterval goroutine, if it is running. Must be
+// called with q.mux held.
+func (q *Queue[T]) stopTicking() {
+	if q.ticker != nil {
+		q.ticker.Stop()
+		close(q.stopTicker)
+		q.ticker, q.stopTicker = nil, nil
+	}
+}
+
+// withinQuota reports whether there is room in the quota for e's criticality.
+// Must be called with q.mux held.
+func (q *Queue[T]) withinQuota(e element[T]) bool {
+	limit, ok := q.Config.Quotas[e.crit]
+	if !ok {
+		return true
+	}
+	n := 0
+	for _, o := range q.l.all() {
+		if o.crit == e.crit && o.ctx.Err() == nil {
+			n++
+		}
+	}
+	return n < limit
+}
+
+// enqueue adds e to q.l in dequeue order. Must be called with q.mux held.
+func (q *Queue[T]) enqueue(e element[T]) {
+	if q.l.len() == 0 {
+		q.filledAt = e.enqueued
+	}
+	if e.front && q.Config.Order != OrderLIFO {
+		q.enqueueFront(e)
+		return
+	}
+	if q.Config.Order == OrderLIFO {
+		i := 0
+		for ; i < q.l.len(); i++ {
+			if !q.less(e.crit, q.l.at(i).crit) {
+				break
+			}
+		}
+		q.l.insertAt(i, e)
+		return
+	}
+	if q.Config.Order == OrderEDF {
+		if at, ok := e.deadline(); ok {
+			// Deadlines mostly arrive in order, so search from the back
+			i := q.l.len()
+			for ; i > 0; i-- {
+				if d, ok := q.l.at(i - 1).deadline(); ok && !d.After(at) {
+					break
+				}
+			}
+			q.l.insertAt(i, e)
+			return
+		}
+	}
+	q.l.pushBack(e)
+}
+
+// enqueueFront adds e to q.l ahead of the elements it would otherwise follow,
+// for Requeue. OrderLIFO already puts new elements first in their criticality.
+func (q *Queue[T]) enqueueFront(e element[T]) {
+	i := 0
+	if q.Config.Order == OrderEDF {
+		at, ok := e.deadline()
+		for ; i < q.l.len(); i++ {
+			d, dok := q.l.at(i).deadline()
+			if !dok || (ok && !d.Before(at)) {
+				break
+			}
+		}
+	}
+	q.l.insertAt(i, e)
+}
+
+// InsertCtx is Insert, with the criticality taken from ctx by
+// shedding.FromContext. Elements with no criticality are shedding.Sheddable.
+func (q *Queue[T]) InsertCtx(ctx context.Context, v T, cancel context.CancelFunc) bool {
+	crit, ok := shedding.FromContext(ctx)
+	if !ok {
+		crit = shedding.Sheddable
+	}
+	return q.Insert(ctx, crit, v, cancel)
+}
+
+// makeSpace sheds an element to make room for e if the queue is full, and
+// returns false if e should be shed instead. Must be called with q.mux held.
+func (q *Queue[T]) makeSpace(e element[T]) bool {
+	if !q.full() {
+		return true
+	}
+	// Clear out anything that's already dead before discarding live elements
+	q.shedLocked()
+	if !q.full() {
+		return true
 	}
-	result = q.l[0].v
-	copy(q.l, q.l[1:])
-	q.l[len(q.l)-1] = element[T]{}
-	q.l = q.l[:len(q.l)-1]
 
 	now := q.Config.Clock.Now()
-	interval := now.Sub(q.lastDequeue)
-	q.lastDequeue = now
-	if len(q.recentDequeue) >= q.Config.TimingHistory {
-		// + 1 because we want to make room to add one
-		start := 1 + len(q.recentDequeue) - q.Config.TimingHistory
-		copy(q.recentDequeue, q.recentDequeue[start:])
-		q.recentDequeue = q.recentDequeue[:q.Config.TimingHistory-1]
-	}
-	q.recentDequeue = append(q.recentDequeue, interval)
+	victim, victimCrit := 0, q.priority(q.l.at(0), now)
+	for i, o := range q.l.all() {
+		if crit := q.priority(o, now); !q.less(victimCrit, crit) {
+			victim, victimCrit = i, crit
+		}
+	}
+	if !q.less(victimCrit, q.priority(e, now)) {
+		// e is the least critical and most recent
+		return false
+	}
+	q.drop(q.l.at(victim), ShedCapacity)
+	q.l.removeAt(victim)
+	return true
+}
+
+// dequeueBy returns the time by which e must be dequeued to meet its deadline,
+// which is its deadline less ProcessingReserve, if it has one
+func (q *Queue[T]) dequeueBy(e element[T]) (time.Time, bool) {
+	at, ok := e.deadline()
+	if !ok {
+		return at, false
+	}
+	return at.Add(-q.Config.ProcessingReserve), true
+}
+
+// view returns the ElementView of e
+func (q *Queue[T]) view(e element[T], now time.Time) ElementView {
+	at, _ := q.dequeueBy(e)
+	return ElementView{
+		Criticality: e.crit,
+		Priority: q.priority(e, now),
+		Deadline: at,
+		Enqueued: e.enqueued,
+		Weight: e.weight,
+	}
+}
+
+// priority returns the criticality used to decide which elements to shed
+// first, taking aging and NoDeadlineLowest into account
+func (q *Queue[T]) priority(e element[T], now time.Time) shedding.Criticality {
+	if q.Config.NoDeadlinePolicy == NoDeadlineLowest {
+		if _, ok := e.deadline(); !ok {
+			if q.less(minPriority, maxPriority) {
+				return minPriority
+			}
+			return maxPriority
+		}
+	}
+	return q.aged(e, now)
+}
+
+// aged returns e's criticality, raised by aging as described on AgingAfter
+func (q *Queue[T]) aged(e element[T], now time.Time) shedding.Criticality {
+	if q.Config.AgingAfter <= 0 {
+		return e.crit
+	}
+	levels := shedding.Criticality(now.Sub(e.enqueued) / q.Config.AgingAfter)
+	if !q.less(e.crit, e.crit+1) {
+		// More critical is downwards
+		levels = -levels
+	}
+	return e.crit + levels
+}
+
+// less reports whether a is less critical than b, according to Config.Less
+func (q *Queue[T]) less(a, b shedding.Criticality) bool {
+	if q.Config.Less != nil {
+		return q.Config.Less(a, b)
+	}
+	return a < b
+}
+
+// Remove dequeues the head element, or with TierWeights, the earliest element
+// of the criticality whose turn it is. ok is false if the queue was empty,
+// after shedding.
+func (q *Queue[T]) Remove() (v T, ok bool) {
+	q.mux.Lock()
+	defer q.unlock()
+	q.shedLocked()
+
+	if q.l.len() == 0 {
+		return v, false
+	}
+	return q.pop(), true
+}
+
+// RemoveNoTiming is Remove, but the dequeue is left out of the wait estimate,
+// for maintenance such as draining on shutdown or discarding a poisoned element,
+// which would otherwise skew it. The next dequeue's interval is still measured
+// from the last one that was recorded.
+func (q *Queue[T]) RemoveNoTiming() (v T, ok bool) {
+	q.mux.Lock()
+	defer q.unlock()
+	q.shedLocked()
+
+	if q.l.len() == 0 {
+		return v, false
+	}
+	return q.take(false).v, true
+}
+
+// RemoveCtx is Remove, but also returns the context v was inserted with, so
+// the consumer can work within its deadline and use its values. The cancel
+// function v was inserted with is not called, so the context stays live, and
+// the caller should call it once finished instead. For
+// elements inserted by InsertBatch, the batch's cancel function is still
+// called once the whole batch has left the queue.
+func (q *Queue[T]) RemoveCtx() (ctx context.Context, v T, ok bool) {
+	q.mux.Lock()
+	defer q.unlock()
+	q.shedLocked()
+
+	if q.l.len() == 0 {
+		return nil, v, false
+	}
+	e := q.take(true)
+	q.recordDequeue(1, e.weight)
+	return e.ctx, e.v, true
+}
+
+// RemoveN dequeues up to n elements from the head. It returns fewer if the
+// queue is shorter than that after shedding. For the wait estimate, the whole
+// batch counts as n dequeues sharing the interval since the previous one,
+// normalised by their total weight.
+func (q *Queue[T]) RemoveN(n int) []T {
+	q.mux.Lock()
+	defer q.unlock()
+	q.shedLocked()
+
+	n = min(n, q.l.len())
+	if n <= 0 {
+		return nil
+	}
+	result := make([]T, n)
+	weight := 0.0
+	for i := range result {
+		e := q.take(false)
+		result[i] = e.v
+		weight += e.weight
+	}
+	q.recordDequeue(n, weight)
 	return result
 }
 
-func (q *Queue[T]) Len() int {
-	q.Config.defaults()
+// Peek returns the element that Remove would return next, without removing it
+// or recording a dequeue. ok is false if the queue is empty.
+func (q *Queue[T]) Peek() (v T, ok bool) {
+	q.mux.Lock()
+	defer q.unlock()
+	q.shedLocked()
+
+	if q.l.len() == 0 {
+		return v, false
+	}
+	return q.l.at(q.next(false)).v, true
+}
+
+// Range calls f for each live element in dequeue order, until f returns false.
+// Elements whose context is done are skipped. Range does not shed or update
+// the wait estimate. f is called with the queue lock held, so it must not call
+// back into the queue.
+func (q *Queue[T]) Range(f func(crit shedding.Criticality, v T) bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	for _, e := range q.l.all() {
+		if e.ctx.Err() != nil {
+			continue
+		}
+		if !f(e.crit, e.v) {
+			return
+		}
+	}
+}
+
+// All returns an iterator over the live elements, as Range
+func (q *Queue[T]) All() iter.Seq2[shedding.Criticality, T] {
+	return q.Range
+}
+
+// Elements is like All, but also yields each element's view, including when
+// it was enqueued
+func (q *Queue[T]) Elements() iter.Seq2[ElementView, T] {
+	return func(yield func(ElementView, T) bool) {
+		q.mux.Lock()
+		defer q.mux.Unlock()
+		q.Config.defaults()
+
+		now := q.Config.Clock.Now()
+		for _, e := range q.l.all() {
+			if e.ctx.Err() != nil {
+				continue
+			}
+			if !yield(q.view(e, now), e.v) {
+				return
+			}
+		}
+	}
+}
 
-	return len(q.l)
+// RemoveWait is like Remove, but blocks until an element is available. It
+// returns ctx.Err() if ctx is done first, or ErrClosed if the queue is closed.
+func (q *Queue[T]) RemoveWait(ctx context.Context) (T, error) {
+	e, err := q.removeWait(ctx, false)
+	return e.v, err
 }
 
-func (q *Queue[T]) updateTiming() {
-	if len(q.recentDequeue) < q.Config.TimingHistory {
-		// Not enough data to estimate yet - this prevents shedding based on deadlines
-		q.expectedWait = 0
+// removeWait implements RemoveWait, returning the whole element. If hold is
+// set, the element is detached with its context kept live, and neither
+// counted as removed nor timed; the caller does that by handOver once it has
+// been received, or puts it back by putBack.
+func (q *Queue[T]) removeWait(ctx context.Context, hold bool) (element[T], error) {
+	var zero element[T]
+	for {
+		q.mux.Lock()
+		if q.closed {
+			q.mux.Unlock()
+			return zero, ErrClosed
+		}
+		q.shedLocked()
+		if q.l.len() > 0 {
+			var e element[T]
+			if hold {
+				e = q.detach(true)
+			} else {
+				e = q.take(false)
+				q.recordDequeue(1, e.weight)
+			}
+			q.unlock()
+			return e, nil
+		}
+		if q.wake == nil {
+			q.wake = make(chan struct{})
+		}
+		wake := q.wake
+		q.unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// Consume returns a channel which is fed elements by RemoveWait, and closed
+// once the queue is closed or ctx is done. The channel is unbuffered, so
+// elements are only removed as fast as they are received, and are subject to
+// shedding until then; each is counted as removed, and its wait timed, when
+// it is received. If ctx is done while an element is waiting to be received,
+// that element is put back at the front of the queue as it was, keeping its
+// enqueue time and deadline, unless the queue has been closed or started
+// shutting down meanwhile.
+func (q *Queue[T]) Consume(ctx context.Context) <-chan T {
+	ch := make(chan T)
+	go func() {
+		defer close(ch)
+		for {
+			// Keep the element's context live until it has been received, in
+			// case it needs putting back
+			e, err := q.removeWait(ctx, true)
+			if err != nil {
+				return
+			}
+			cancel := e.cancel
+			if e.unwatch == nil {
+				// A batch's cancel function, which detach has already called
+				cancel = nil
+			}
+			select {
+			case ch <- e.v:
+				q.handOver(e)
+				if cancel != nil {
+					cancel()
+				}
+			case <-ctx.Done():
+				e.cancel = cancel
+				q.putBack(e)
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// handOver counts e, held by removeWait, as removed now that it has been
+// received, and records the dequeue timing.
+func (q *Queue[T]) handOver(e element[T]) {
+	q.mux.Lock()
+	q.countRemoved(e)
+	q.recordDequeue(1, e.weight)
+	q.unlock()
+}
+
+// putBack returns e, held by removeWait, to the front of the queue. Since it
+// was never counted as removed, it isn't counted as inserted again either,
+// and keeps its enqueue time, deadline and span; but it is shed as add would
+// if its key has been taken or there is no longer room for it.
+func (q *Queue[T]) putBack(e element[T]) {
+	q.track(&e)
+
+	q.mux.Lock()
+	defer q.unlock()
+	if q.closed || q.draining {
+		q.discard(e)
 		return
 	}
-	if !q.expectedWaitAt.Before(q.lastDequeue) {
-		// No new data, no need to recompute
+	if e.key != "" && q.duplicate(e.key) {
+		q.drop(e, ShedDuplicate)
+		return
+	}
+	if !q.withinQuota(e) {
+		q.drop(e, ShedQuota)
+		return
+	}
+	if !q.makeSpace(e) {
+		q.drop(e, ShedCapacity)
+		return
+	}
+	if e.key != "" {
+		if q.keys == nil {
+			q.keys = map[string]keyed{}
+		}
+		q.keys[e.key] = keyed{e.ctx, e.done}
+	}
+	e.front = true
+	q.enqueue(e)
+	q.broadcast()
+	q.shedLocked()
+}
+
+// Close marks the queue as closed, cancels and discards every remaining
+// element, and wakes any callers blocked in RemoveWait. Subsequent inserts are
+// rejected.
+func (q *Queue[T]) Close() {
+	q.mux.Lock()
+	defer q.unlock()
+	if q.closed {
 		return
 	}
+	q.closed = true
+	q.stopTicking()
+	q.discardAll()
+	q.broadcast()
+}
+
+// Clear cancels and discards every element, like Close, but leaves the queue
+// open for further inserts. The timing history is kept.
+func (q *Queue[T]) Clear() {
+	q.mux.Lock()
+	defer q.unlock()
+	q.discardAll()
+}
+
+// RemoveFunc cancels and discards every element for which pred returns true,
+// like Clear, and returns how many there were. The rest keep their order. Each
+// is reported to OnDiscard. pred is called with the queue lock held, so it must
+// not call back into the queue.
+func (q *Queue[T]) RemoveFunc(pred func(crit shedding.Criticality, v T) bool) int {
+	q.mux.Lock()
+	defer q.unlock()
+
+	n := 0
+	q.l.filter(func(_ int, e element[T]) bool {
+		if !pred(e.crit, e.v) {
+			return true
+		}
+		q.discard(e)
+		n++
+		return false
+	})
+	return n
+}
+
+// discardAll removes every element, without counting them as removed or shed.
+// Must be called with q.mux held; the cancel functions are called by unlock.
+func (q *Queue[T]) discardAll() {
+	for _, e := range q.l.all() {
+		q.discard(e)
+	}
+	q.l.reset()
+}
 
-	intervals := q.recentDequeue
-	if q.Config.DiscardOutliers > 0 {
-		intervals := make([]time.Duration, len(q.recentDequeue))
-		copy(intervals, q.recentDequeue)
-		sort.Slice(intervals, func(i, j int) bool {return intervals[i] < intervals[j]})
-		intervals = intervals[q.Config.DiscardOutliers:len(intervals)-q.Config.DiscardOutliers]
+// discard cancels e, which the caller removes from q.l, without counting it
+// as removed or shed. Must be called with q.mux held.
+func (q *Queue[T]) discard(e element[T]) {
+	q.forget(e)
+	q.cancels = append(q.cancels, e.cancel)
+	if e.span != nil {
+		e.span.Shed(ShedCancelled)
 	}
+	if f := q.Config.OnDiscard; f != nil {
+		q.notify = append(q.notify, func() { f(e.crit, e.v) })
+	}
+}
+
+// Shutdown rejects further inserts, then waits for the consumers to drain the
+// queue before closing it. If ctx is done first, the queue is closed with
+// whatever remains, as by Close, and ctx.Err() is returned.
+func (q *Queue[T]) Shutdown(ctx context.Context) error {
+	q.mux.Lock()
+	if q.closed {
+		q.mux.Unlock()
+		return nil
+	}
+	q.draining = true
+	drained := q.emptied()
+	q.unlock()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	q.Close()
+	return err
+}
+
+// WaitUntilEmpty blocks until the queue is empty, or returns ctx.Err() if ctx
+// is done first. Elements whose context is done still count until they are
+// shed.
+func (q *Queue[T]) WaitUntilEmpty(ctx context.Context) error {
+	q.mux.Lock()
+	empty := q.emptied()
+	q.unlock()
+
+	select {
+	case <-empty:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	var total time.Duration
-	for _, t := range intervals {
-		total += t
+// emptied returns a channel which unlock closes once the queue is empty. Must
+// be called with q.mux held.
+func (q *Queue[T]) emptied() <-chan struct{} {
+	if q.drained == nil {
+		q.drained = make(chan struct{})
 	}
-	q.expectedWait = total / time.Duration(len(intervals))
-	q.expectedWaitAt = q.lastDequeue
+	return q.drained
+}
+
+// broadcast wakes all RemoveWait callers. Must be called with q.mux held.
+func (q *Queue[T]) broadcast() {
+	if q.wake != nil {
+		close(q.wake)
+		q.wake = nil
+	}
+}
+
+// drop records that e has been shed. Must be called with q.mux held; the
+// element is cancelled and reported when the lock is released by unlock.
+func (q *Queue[T]) drop(e element[T], reason ShedReason) {
+	q.dropProjected(e, reason, time.Time{})
+}
+
+// dropProjected is drop, for an element which was projected to be dequeued at
+// projected, for Logger
+func (q *Queue[T]) dropProjected(e element[T], reason ShedReason, projected time.Time) {
+	q.forget(e)
+	q.nShed++
+	if q.nShedBy == nil {
+		q.nShedBy = map[ShedReason]uint64{}
+	}
+	q.nShedBy[reason]++
+	if q.Config.Metrics != nil {
+		q.Config.Metrics.Shed(e.crit, reason)
+	}
+	if e.span != nil {
+		e.span.Shed(reason)
+	}
+	q.cancels = append(q.cancels, e.cancel)
+	q.dropped = append(q.dropped, shedRecord[T]{e, reason})
+	if n := q.Config.DeadLetterSize; n > 0 {
+		q.deadLetter.reserve(n)
+		for q.deadLetter.len() >= n {
+			q.deadLetter.popFront()
+		}
+		q.deadLetter.pushBack(e.v)
+	}
+	if q.Config.Logger != nil {
+		q.logShed(e, reason, projected)
+	}
+}
+
+// logShed queues a log of e being shed, to be written by unlock. Must be
+// called with q.mux held.
+func (q *Queue[T]) logShed(e element[T], reason ShedReason, projected time.Time) {
+	logger := q.Config.Logger
+	attrs := []slog.Attr{
+		slog.String("criticality", e.crit.String()),
+		slog.String("reason", reason.String()),
+		slog.Duration("waited", q.Config.Clock.Since(e.enqueued)),
+		slog.Duration("expected_wait", q.expectedWait),
+	}
+	if at, ok := e.deadline(); ok {
+		attrs = append(attrs, slog.Time("deadline", at))
+	}
+	if !projected.IsZero() {
+		attrs = append(attrs, slog.Time("projected", projected))
+	}
+	q.notify = append(q.notify, func() {
+		logger.LogAttrs(e.ctx, slog.LevelDebug, "shed", attrs...)
+	})
+}
+
+// unlock releases q.mux, then calls the cancel functions of any elements that
+// were removed or shed while it was held, and reports them. It also tells
+// Shutdown and WaitUntilEmpty once the queue is empty, and InsertWait once
+// there is room.
+func (q *Queue[T]) unlock() {
+	if q.Config.OnStats != nil {
+		q.reportStats()
+	}
+	cancels, l, dequeued, notify := q.cancels, q.dropped, q.dequeued, q.notify
+	q.cancels, q.dropped, q.dequeued, q.notify = nil, nil, nil, nil
+	onShed, onDequeue := q.Config.OnShed, q.Config.OnDequeue
+	if q.drained != nil && q.l.len() == 0 {
+		close(q.drained)
+		q.drained = nil
+	}
+	if q.space != nil && (q.closed || q.draining || !q.full()) {
+		close(q.space)
+		q.space = nil
+	}
+	q.mux.Unlock()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+	for _, d := range l {
+		if onShed != nil {
+			onShed(d.e.crit, d.e.v, d.reason)
+		}
+	}
+	for _, d := range dequeued {
+		onDequeue(d.e.crit, d.e.v, d.waited)
+	}
+	for _, f := range notify {
+		f()
+	}
+}
+
+// pop removes the next element and records the dequeue timing. Must be called
+// with q.mux held and q.l non-empty.
+func (q *Queue[T]) pop() T {
+	e := q.take(false)
+	q.recordDequeue(1, e.weight)
+	return e.v
+}
+
+// take removes the next element, without recording the dequeue timing. Must be
+// called with q.mux held and q.l non-empty. keepCtx is as for detach.
+func (q *Queue[T]) take(keepCtx bool) element[T] {
+	e := q.detach(keepCtx)
+	q.countRemoved(e)
+	return e
+}
+
+// detach removes the next element from q.l, without counting it as removed.
+// Must be called with q.mux held and q.l non-empty. The element's cancel
+// function is called by unlock, since it is now owned by the consumer and no
+// longer needs watching; unless keepCtx is set, in which case the queue only
+// stops watching it, so that the context stays live for the consumer.
+// Elements inserted in a batch share their cancel function, so it is always
+// called.
+func (q *Queue[T]) detach(keepCtx bool) element[T] {
+	var e element[T]
+	if i := q.next(true); i == 0 {
+		e = q.l.popFront()
+	} else {
+		e = q.l.at(i)
+		q.l.removeAt(i)
+	}
+	q.forget(e)
+	if keepCtx && e.unwatch != nil {
+		q.cancels = append(q.cancels, e.unwatch)
+	} else {
+		q.cancels = append(q.cancels, e.cancel)
+	}
+	return e
+}
+
+// countRemoved counts e, which has left the queue, as removed. Must be called
+// with q.mux held.
+func (q *Queue[T]) countRemoved(e element[T]) {
+	q.nRemoved++
+	waited := q.Config.Clock.Since(e.enqueued)
+	q.waits.add(waited)
+	if q.Config.Metrics != nil {
+		q.Config.Metrics.Removed(e.crit, waited)
+	}
+	if q.Config.OnDequeue != nil {
+		q.dequeued = append(q.dequeued, dequeueRecord[T]{e, waited})
+	}
+	if e.span != nil {
+		e.span.Dequeued()
+	}
+}
+
+func (q *Queue[T]) Len() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.Config.defaults()
+
+	return q.l.len()
+}
+
+// Grow makes room for at least n more elements without reallocating, e.g.
+// ahead of a known burst of inserts
+func (q *Queue[T]) Grow(n int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if n > 0 {
+		q.l.reserve(q.l.len() + n)
+	}
+}
+
+// LiveLen is Len, not counting elements whose context is done but which have
+// not been shed yet. It checks every element, so it costs O(n) where Len is
+// O(1), but it does not shed.
+func (q *Queue[T]) LiveLen() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	n := 0
+	for _, e := range q.l.all() {
+		if e.ctx.Err() == nil {
+			n++
+		}
+	}
+	return n
 }
 
 func (q *Queue[T]) shed() {
+	q.mux.Lock()
+	defer q.unlock()
+	q.shedLocked()
+}
+
+// DeadLetter returns the most recently shed elements, oldest first, up to
+// Config.DeadLetterSize of them
+func (q *Queue[T]) DeadLetter() []T {
 	q.mux.Lock()
 	defer q.mux.Unlock()
+
+	result := make([]T, 0, q.deadLetter.len())
+	for _, v := range q.deadLetter.all() {
+		result = append(result, v)
+	}
+	return result
+}
+
+// Shed sheds now, and returns the elements that were shed, in the order they
+// were shed, e.g. so they can be returned to a message broker. They are also
+// reported to OnShed as usual.
+func (q *Queue[T]) Shed() []T {
+	q.mux.Lock()
+	defer q.unlock()
+	q.shedLocked()
+
+	var result []T
+	for _, d := range q.dropped {
+		result = append(result, d.e.v)
+	}
+	return result
+}
+
+// shedLocked is shed, for callers which already hold q.mux
+func (q *Queue[T]) shedLocked() {
 	q.Config.defaults()
 	q.updateTiming()
 
-	// First, shed any entries which have already missed their deadline
-
-	l := []element[T]{}
-	for _, e := range q.l {
+	// First, shed any entries which have already missed their deadline.
+	//
+	// Contexts may be cancelled concurrently at any point in this pass, but
+	// each element's Err is read only here, once, and everything else the
+	// pass reads is fixed for the element's lifetime: criticality, weight and
+	// enqueue time are set on insert, and a context's Deadline never changes.
+	// So the pass always sees a consistent state; an element cancelled after
+	// this check is kept for now, and shed by the next pass, which the
+	// context.AfterFunc callback registered by track runs once its context is
+	// done. insert runs a pass itself before returning, so an element whose
+	// context is already done on insert is shed then.
+	now := q.Config.Clock.Now()
+	q.l.filter(func(_ int, e element[T]) bool {
 		if e.ctx.Err() != nil {
 			// Shed anything that's dead already
-			e.cancel()
-			continue
+			q.drop(e, ShedCancelled)
+			return false
+		}
+		if at, ok := e.deadline(); ok && !at.After(now) {
+			// The deadline has passed by our clock, even if the context's timer
+			// hasn't fired yet, or the deadline came from InsertDeadline
+			q.drop(e, ShedDeadline)
+			return false
 		}
-		l = append(l, e)
+		return true
+	})
+
+	// Next, let the policy shed anything that isn't expected to meet its
+	// deadline. The default policy does nothing without an estimate.
+	policy := q.Config.ShedPolicy
+	var wait time.Duration
+	if q.expectedWait > 0 {
+		wait = q.itemWait()
+	}
+	// Project from when the next dequeue is due to start, in the order
+	// elements are due to be dequeued
+	from := now.Add(q.overrun(now))
+	var order []int
+	if policy != nil || wait > 0 {
+		order = q.dequeueOrder()
+	}
+	if policy == nil && (wait == 0 || !q.mayMiss(order, from, wait)) {
+		// The default policy would keep everything, so skip building its input
+		q.trackOverload(false, now)
+		return
 	}
 
-	// Next we want to shed anything that isn't expected to meet its deadline -
-	// but this is a bit trickier, because if a higher-criticality entry would
-	// be doable then we need to shed before that point. We use a multiple-list
-	// approach to make backtracking easy.
-	byCrit := map[shedding.Criticality][]int{} // values are indexes into l
-	for i, e := range l {
-		byCrit[e.crit] = append(byCrit[e.crit], i)
+	views := q.views[:0]
+	if order == nil {
+		for _, e := range q.l.all() {
+			views = append(views, q.view(e, now))
+		}
+	} else {
+		for _, i := range order {
+			views = append(views, q.view(q.l.at(i), now))
+		}
 	}
+	q.views = views
 
-	// Baseline time for checking ctx.Deadline
-	now := q.Config.Clock.Now()
-	
+	var result []int
+	if policy == nil {
+		var saved int
+		result, saved = DefaultPolicy{Less: q.Config.Less}.shed(views, from, wait, &q.scratch)
+		if !q.Config.DryRun {
+			q.nSaved += uint64(saved)
+		}
+	} else {
+		result = policy.Shed(views, from, wait)
+	}
 
-		if at, ok := e.ctx.Deadline(); ok && at.Before(expectedDequeue) {
-			// This item is not expected to be done before its deadline; shed it immediately
-			e.cancel()
-			continue
+	// keep and projected are indexed by position in q.l
+	keep := slices.Grow(q.scratch.kept[:0], len(views))[:len(views)]
+	clear(keep)
+	q.scratch.kept = keep
+	for _, i := range result {
+		if i >= 0 && i < len(keep) {
+			if order != nil {
+				i = order[i]
+			}
+			keep[i] = true
 		}
+	}
+	// When each element to be shed would have been dequeued, after the ones
+	// kept ahead of it, for Logger
+	var projected []time.Time
+	if q.Config.Logger != nil && wait > 0 {
+		projected = slices.Grow(q.scratch.projected[:0], len(views))[:len(views)]
+		clear(projected)
+		q.scratch.projected = projected
+		ahead := 0.0
+		for j, v := range views {
+			i := j
+			if order != nil {
+				i = order[j]
+			}
+			if keep[i] {
+				ahead += v.Weight
+			} else {
+				projected[i] = from.Add(time.Duration((ahead + v.Weight) * float64(wait)))
+			}
+		}
+	}
+	shed := false
+	if q.Config.DryRun {
+		for i, e := range q.l.all() {
+			if keep[i] {
+				continue
+			}
+			shed = true
+			if !e.wouldShed {
+				q.wouldShed(&e, ShedDeadline)
+				q.l.set(i, e)
+			}
+		}
+		q.trackOverload(shed, now)
+		return
+	}
+	q.l.filter(func(i int, e element[T]) bool {
+		if keep[i] {
+			return true
+		}
+		var at time.Time
+		if projected != nil {
+			at = projected[i]
+		}
+		q.dropProjected(e, ShedDeadline, at)
+		shed = true
+		return false
+	})
+	q.trackOverload(shed, now)
+}
 
-		expectedDequeue = expectedDequeue.Add(q.expectedWait)
-		l = append(l, e)
+// mayMiss reports whether any element is projected to miss its deadline, if
+// nothing is shed, allowing wait per unit of weight. order is as returned by
+// dequeueOrder. Must be called with q.mux held.
+func (q *Queue[T]) mayMiss(order []int, now time.Time, wait time.Duration) bool {
+	ahead := 0.0
+	for j, e := range q.l.all() {
+		if order != nil {
+			e = q.l.at(order[j])
+		}
+		ahead += e.weight
+		if at, ok := q.dequeueBy(e); ok && ahead > float64(at.Sub(now))/float64(wait) {
+			return true
+		}
 	}
+	return false
+}
 
-	q.l = l
-}
\ No newline at end of file
+// trackOverload records whether a shed pass shed anything for its deadline,
+// and queues OnOverloadStart or OnOverloadEnd if that changed the overload
+// state. Must be called with q.mux held.
+func (q *Queue[T]) trackOverload(shed bool, now time.Time) {
+	switch {
+	case shed:
+		q.lastOverload = now
+		if !q.overloaded {
+			q.overloaded = true
+			if q.Config.OnOverloadStart != nil {
+				q.notify = append(q.notify, q.Config.OnOverloadStart)
+			}
+		}
+	case q.overloaded && now.Sub(q.lastOverload) >= q.Config.OverloadCooldown:
+		q.overloaded = false
+		if q.Config.OnOverloadEnd != nil {
+			q.notify = append(q.notify, q.Config.OnOverloadEnd)
+		}
+	}
+}
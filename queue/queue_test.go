@@ -0,0 +1,1351 @@
+package queue
+
+import (
+	"context"
+	"maps"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/benbjohnson/clock"
+)
+
+// removeAll dequeues everything left in q
+func removeAll[T any](q *Queue[T]) []T {
+	var result []T
+	for {
+		v, ok := q.Remove()
+		if !ok {
+			return result
+		}
+		result = append(result, v)
+	}
+}
+
+// settledGoroutines returns the number of goroutines once any started by the
+// queue in the background have had a chance to finish
+func settledGoroutines() int {
+	n := runtime.NumGoroutine()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		m := runtime.NumGoroutine()
+		if m == n {
+			return n
+		}
+		n = m
+	}
+	return n
+}
+
+func TestConcurrentInsertRemove(t *testing.T) {
+	const producers, consumers, each = 8, 8, 500
+	q := &Queue[int]{}
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				q.Insert(ctx, shedding.Sheddable, i, cancel)
+				q.Len()
+			}
+		}()
+	}
+	var inserted atomic.Bool
+	go func() {
+		wg.Wait()
+		inserted.Store(true)
+	}()
+	removed := make(chan int, consumers)
+	for c := 0; c < consumers; c++ {
+		go func() {
+			n := 0
+			for {
+				if _, ok := q.Remove(); ok {
+					n++
+					continue
+				}
+				// Check the producers before Len, so nothing can be
+				// inserted after the queue is seen to be empty
+				if inserted.Load() && q.Len() == 0 {
+					removed <- n
+					return
+				}
+			}
+		}()
+	}
+
+	total := 0
+	for c := 0; c < consumers; c++ {
+		total += <-removed
+	}
+	if total != producers*each {
+		t.Errorf("removed %d elements, want %d", total, producers*each)
+	}
+}
+
+func TestRemoveWait(t *testing.T) {
+	q := &Queue[string]{}
+	got := make(chan string)
+	go func() {
+		v, err := q.RemoveWait(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- v
+	}()
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	if v := <-got; v != "a" {
+		t.Errorf("RemoveWait() = %q, want a", v)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := q.RemoveWait(ctx); err != context.Canceled {
+		t.Errorf("RemoveWait() with a cancelled context returned %v", err)
+	}
+}
+
+func TestRemoveWaitClosed(t *testing.T) {
+	q := &Queue[string]{}
+	const waiters = 5
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			_, err := q.RemoveWait(context.Background())
+			errs <- err
+		}()
+	}
+	// Give the waiters a chance to block, though the result is the same if
+	// they haven't yet
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	for i := 0; i < waiters; i++ {
+		if err := <-errs; err != ErrClosed {
+			t.Errorf("RemoveWait() on closing returned %v, want ErrClosed", err)
+		}
+	}
+}
+
+func TestRemoveEmpty(t *testing.T) {
+	q := &Queue[int]{}
+	if v, ok := q.Remove(); ok {
+		t.Errorf("Remove() on an empty queue = %d, true", v)
+	}
+	// A zero value is still a value
+	q.Insert(context.Background(), shedding.Sheddable, 0, nil)
+	if v, ok := q.Remove(); !ok || v != 0 {
+		t.Errorf("Remove() = %d, %v, want 0, true", v, ok)
+	}
+	if _, ok := q.Remove(); ok {
+		t.Error("Remove() succeeded on a drained queue")
+	}
+}
+
+func TestClose(t *testing.T) {
+	const n = 50
+	q := &Queue[int]{}
+	before := settledGoroutines()
+	calls := make([]int, n)
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		q.Insert(ctx, shedding.Sheddable, i, func() {
+			calls[i]++
+			cancel()
+		})
+	}
+	q.Close()
+	q.Close() // which does nothing the second time
+
+	for i, c := range calls {
+		if c != 1 {
+			t.Errorf("cancel for element %d called %d times, want once", i, c)
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("Len() = %d after Close", q.Len())
+	}
+	if q.Insert(context.Background(), shedding.Sheddable, n, nil) {
+		t.Error("Insert after Close was accepted")
+	}
+	if after := settledGoroutines(); after > before {
+		t.Errorf("%d goroutines after Close, up from %d", after, before)
+	}
+}
+
+func TestRemoveCancels(t *testing.T) {
+	const n = 1000
+	q := &Queue[int]{}
+	before := settledGoroutines()
+	cancelled := 0
+	for i := 0; i < n; i++ {
+		// The parent is never cancelled, so only the queue can release these
+		ctx, cancel := context.WithCancel(context.Background())
+		q.Insert(ctx, shedding.Sheddable, i, func() {
+			cancel()
+			cancelled++
+		})
+	}
+	removeAll(q)
+
+	if cancelled != n {
+		t.Errorf("%d of %d cancel functions called by Remove", cancelled, n)
+	}
+	if after := settledGoroutines(); after > before {
+		t.Errorf("%d goroutines after removing everything, up from %d", after, before)
+	}
+}
+
+func TestMaxLen(t *testing.T) {
+	q := &Queue[string]{}
+	q.Config.MaxLen = 3
+	var shed []string
+	q.Config.OnShed = func(_ shedding.Criticality, v string, reason ShedReason) {
+		if reason == ShedCapacity {
+			shed = append(shed, v)
+		}
+	}
+	for _, v := range []string{"a", "b", "c"} {
+		q.Insert(context.Background(), shedding.Sheddable, v, nil)
+	}
+	if q.Insert(context.Background(), shedding.Sheddable, "d", nil) {
+		t.Error("sheddable element accepted into a full queue of sheddable elements")
+	}
+	// The most recent of the least critical makes way
+	if !q.Insert(context.Background(), shedding.Critical, "critical", nil) {
+		t.Error("critical element rejected from a full queue of sheddable elements")
+	}
+	if got := removeAll(q); !slices.Equal(got, []string{"a", "b", "critical"}) {
+		t.Errorf("queue holds %q, want [a b critical]", got)
+	}
+	if !slices.Equal(shed, []string{"d", "c"}) {
+		t.Errorf("shed for capacity %q, want [d c]", shed)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	q := &Queue[string]{}
+	q.Config.Quotas = map[shedding.Criticality]int{shedding.Sheddable: 2}
+	doomed, cancel := context.WithCancel(context.Background())
+	q.Insert(doomed, shedding.Sheddable, "doomed", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	cancel()
+	// Whether or not it has been shed yet, the cancelled element doesn't count
+	// against the quota
+	if !q.Insert(context.Background(), shedding.Sheddable, "b", nil) {
+		t.Error("sheddable element within quota of live elements was rejected")
+	}
+	if q.Insert(context.Background(), shedding.Sheddable, "over", nil) {
+		t.Error("sheddable element over quota was accepted")
+	}
+	for _, v := range []string{"c1", "c2", "c3"} {
+		if !q.Insert(context.Background(), shedding.Critical, v, nil) {
+			t.Errorf("critical %s rejected while the sheddable tier is saturated", v)
+		}
+	}
+	if s := q.Stats(); s.ShedByReason[ShedQuota] != 1 {
+		t.Errorf("%d shed for quota, want 1", s.ShedByReason[ShedQuota])
+	}
+	if got := removeAll(q); !slices.Equal(got, []string{"a", "b", "c1", "c2", "c3"}) {
+		t.Errorf("queue holds %q", got)
+	}
+}
+
+func TestAging(t *testing.T) {
+	for _, aged := range []bool{false, true} {
+		mc := clock.NewMock()
+		mc.Set(time.Now())
+		q := &Queue[string]{}
+		q.Config.Clock = mc
+		q.Config.MaxLen = 1
+		q.Config.AgingAfter = time.Minute
+		q.Insert(context.Background(), shedding.Sheddable, "old", nil)
+		if aged {
+			// Two levels, from Sheddable up to Critical
+			mc.Add(2 * time.Minute)
+		}
+
+		// Once aged, the old element ranks with the new one, which arrived
+		// later, so the new one is the one not to fit
+		q.Insert(context.Background(), shedding.Critical, "new", nil)
+		want := "new"
+		if aged {
+			want = "old"
+		}
+		if got := removeAll(q); len(got) != 1 || got[0] != want {
+			t.Errorf("aged=%v: dequeued %q, want %s", aged, got, want)
+		}
+	}
+}
+
+func TestInsertCtx(t *testing.T) {
+	q := &Queue[string]{}
+	q.InsertCtx(context.Background(), "default", nil)
+	q.InsertCtx(shedding.WithCriticality(context.Background(), shedding.Critical), "critical", nil)
+	got := map[string]shedding.Criticality{}
+	for crit, v := range q.All() {
+		got[v] = crit
+	}
+	if got["default"] != shedding.Sheddable || got["critical"] != shedding.Critical {
+		t.Errorf("inserted with criticalities %v, want Sheddable by default and Critical from the context", got)
+	}
+}
+
+func TestOrderEDF(t *testing.T) {
+	q := &Queue[string]{}
+	q.Config.Order = OrderEDF
+	now := time.Now()
+	for _, e := range []struct {
+		v    string
+		crit shedding.Criticality
+		in   time.Duration // zero for no deadline
+	}{
+		{"3h", shedding.Critical, 3 * time.Hour},
+		{"none", shedding.CriticalPlus, 0},
+		{"1h", shedding.Sheddable, time.Hour},
+		{"2h", shedding.CriticalPlus, 2 * time.Hour},
+		{"1h later", shedding.Sheddable, time.Hour},
+	} {
+		ctx, cancel := context.Background(), context.CancelFunc(nil)
+		if e.in > 0 {
+			ctx, cancel = context.WithDeadline(ctx, now.Add(e.in))
+			defer cancel()
+		}
+		q.Insert(ctx, e.crit, e.v, cancel)
+	}
+
+	// Across criticalities, with no deadline last and ties in insertion order
+	want := []string{"1h", "1h later", "2h", "3h", "none"}
+	if got := removeAll(q); !slices.Equal(got, want) {
+		t.Errorf("dequeued %q, want %q", got, want)
+	}
+}
+
+// BenchmarkInsertBatch compares inserting 1000 elements with InsertBatch and
+// with Insert in a loop
+func BenchmarkInsertBatch(b *testing.B) {
+	vs := make([]int, 1000)
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			q := &Queue[int]{}
+			ctx, cancel := context.WithCancel(context.Background())
+			q.InsertBatch(ctx, shedding.Sheddable, vs, cancel)
+			b.StopTimer()
+			q.Close()
+			b.StartTimer()
+		}
+	})
+
+	b.Run("loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			q := &Queue[int]{}
+			ctx, cancel := context.WithCancel(context.Background())
+			for _, v := range vs {
+				q.Insert(ctx, shedding.Sheddable, v, nil)
+			}
+			b.StopTimer()
+			q.Close()
+			cancel()
+			b.StartTimer()
+		}
+	})
+}
+
+func TestInsertBatch(t *testing.T) {
+	q := &Queue[string]{}
+	calls := 0
+	if n := q.InsertBatch(context.Background(), shedding.Sheddable, []string{"a", "b", "c"}, func() { calls++ }); n != 3 {
+		t.Fatalf("InsertBatch() = %d, want 3", n)
+	}
+	q.Remove()
+	q.Remove()
+	if calls != 0 {
+		t.Errorf("cancel called with an element of the batch still queued")
+	}
+	q.Remove()
+	if calls != 1 {
+		t.Errorf("cancel called %d times once the batch was removed, want once", calls)
+	}
+}
+
+func TestRemoveN(t *testing.T) {
+	q := &Queue[string]{}
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	q.Insert(ctx, shedding.Sheddable, "cancelled", cancel)
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "c", nil)
+
+	if got := q.RemoveN(0); len(got) != 0 {
+		t.Errorf("RemoveN(0) = %q, want nothing", got)
+	}
+	if n := q.Len(); n != 4 {
+		t.Errorf("Len() after RemoveN(0) = %d, want 4", n)
+	}
+
+	cancel()
+	if got := q.RemoveN(2); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("RemoveN(2) = %q, want [a b], skipping the cancelled element", got)
+	}
+	if got := q.RemoveN(10); !slices.Equal(got, []string{"c"}) {
+		t.Errorf("RemoveN(10) = %q, want what's left, [c]", got)
+	}
+	if got := q.RemoveN(1); len(got) != 0 {
+		t.Errorf("RemoveN(1) of an empty queue = %q, want nothing", got)
+	}
+}
+
+func TestRange(t *testing.T) {
+	q := &Queue[string]{}
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	q.Insert(ctx, shedding.Critical, "cancelled", nil)
+	q.Insert(context.Background(), shedding.Critical, "b", nil)
+	cancel()
+
+	var got []string
+	for _, v := range q.All() {
+		got = append(got, v)
+	}
+	if !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("All() yields %q, want the live elements [a b]", got)
+	}
+
+	got = nil
+	q.Range(func(_ shedding.Criticality, v string) bool {
+		got = append(got, v)
+		return false
+	})
+	if !slices.Equal(got, []string{"a"}) {
+		t.Errorf("Range stopped after %q, want [a]", got)
+	}
+	if s := q.Stats(); s.Removed != 0 || !s.LastDequeue.IsZero() {
+		t.Errorf("iterating recorded a dequeue: %+v", s)
+	}
+}
+
+func TestNoGoroutinePerElement(t *testing.T) {
+	q := &Queue[int]{}
+	defer q.Close()
+	before := settledGoroutines()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 100000; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, i, nil)
+		q.Insert(ctx, shedding.Sheddable, i, nil)
+		q.RemoveN(2)
+	}
+	// Elements which are still queued don't need one either
+	for i := 0; i < 1000; i++ {
+		q.Insert(ctx, shedding.Sheddable, i, nil)
+	}
+	if n := settledGoroutines() - before; n > 0 {
+		t.Errorf("%d more goroutines after processing 100k elements", n)
+	}
+}
+
+func TestNilCancel(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	q.Config.MaxLen = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	late, cancelLate := context.WithDeadline(context.Background(), mc.Now().Add(time.Millisecond))
+	defer cancelLate()
+
+	// Shed for each reason, then removed, all with nothing to cancel
+	q.Insert(ctx, shedding.Sheddable, "cancelled", nil)
+	cancel()
+	q.Insert(late, shedding.Sheddable, "late", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "full", nil)
+	q.Insert(context.Background(), shedding.Critical, "a", nil)
+	q.Insert(context.Background(), shedding.Critical, "b", nil)
+	if got := removeAll(q); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("dequeued %q, want [a b]", got)
+	}
+	if s := q.Stats(); s.Shed != 3 {
+		t.Errorf("shed %d elements, want 3", s.Shed)
+	}
+}
+
+func TestOnDequeue(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	waited := map[string]time.Duration{}
+	q.Config.OnDequeue = func(_ shedding.Criticality, v string, d time.Duration) {
+		q.Len() // the lock isn't held
+		waited[v] = d
+	}
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	mc.Add(time.Second)
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "c", nil)
+	mc.Add(2 * time.Second)
+	q.Remove()
+	mc.Add(time.Second)
+	q.RemoveN(2)
+
+	want := map[string]time.Duration{"a": 3 * time.Second, "b": 3 * time.Second, "c": 3 * time.Second}
+	if !maps.Equal(waited, want) {
+		t.Errorf("OnDequeue reported waits %v, want %v", waited, want)
+	}
+}
+
+func TestClear(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Insert(ctx, shedding.Sheddable, "a", nil)
+	q.Insert(ctx, shedding.Sheddable, "b", nil)
+	wait := q.ExpectedWait()
+
+	q.Clear()
+	if n := q.Len(); n != 0 {
+		t.Errorf("Len() after Clear = %d, want 0", n)
+	}
+	if got := q.ExpectedWait(); got != wait {
+		t.Errorf("ExpectedWait() after Clear = %v, want %v", got, wait)
+	}
+	if !q.Insert(context.Background(), shedding.Sheddable, "c", nil) {
+		t.Fatal("Insert after Clear was rejected")
+	}
+	mc.Add(time.Millisecond)
+	if got := removeAll(q); len(got) != 1 || got[0] != "c" {
+		t.Errorf("queue after Clear and Insert holds %q, want [c]", got)
+	}
+}
+
+func TestTryInsert(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	q.Config.MaxLen = 1
+
+	expired, cancel := context.WithDeadline(context.Background(), mc.Now().Add(-time.Second))
+	defer cancel()
+	if q.TryInsert(expired, shedding.Critical, "expired", nil) {
+		t.Error("TryInsert of an element past its deadline = true, want false")
+	}
+	if !q.TryInsert(context.Background(), shedding.Critical, "a", nil) {
+		t.Error("TryInsert into an empty queue = false, want true")
+	}
+	if q.TryInsert(context.Background(), shedding.Critical, "full", nil) {
+		t.Error("TryInsert into a full queue = true, want false")
+	}
+	if got := removeAll(q); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("queue holds %q, want [a]", got)
+	}
+}
+
+func TestElementAges(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	for _, v := range []string{"a", "b", "c"} {
+		q.Insert(context.Background(), shedding.Sheddable, v, nil)
+		mc.Add(time.Second)
+	}
+
+	var ages []time.Duration
+	for e := range q.Elements() {
+		ages = append(ages, mc.Now().Sub(e.Enqueued))
+	}
+	if want := []time.Duration{3 * time.Second, 2 * time.Second, time.Second}; !slices.Equal(ages, want) {
+		t.Errorf("element ages %v, want %v, oldest first", ages, want)
+	}
+	if s := q.Stats(); s.OldestAge != 3*time.Second {
+		t.Errorf("OldestAge = %v, want 3s", s.OldestAge)
+	}
+}
+
+// chanShedder is a Shedder over a plain channel, which never sheds
+type chanShedder[T any] chan T
+
+func (c chanShedder[T]) Insert(_ context.Context, _ shedding.Criticality, v T, cancel context.CancelFunc) bool {
+	select {
+	case c <- v:
+		return true
+	default:
+		if cancel != nil {
+			cancel()
+		}
+		return false
+	}
+}
+
+func (c chanShedder[T]) Remove() (v T, ok bool) {
+	select {
+	case v = <-c:
+		return v, true
+	default:
+		return v, false
+	}
+}
+
+func (c chanShedder[T]) Len() int { return len(c) }
+
+func TestShedder(t *testing.T) {
+	for name, s := range map[string]Shedder[string]{
+		"Queue":   &Queue[string]{},
+		"channel": make(chanShedder[string], 4),
+	} {
+		for _, v := range []string{"a", "b"} {
+			if !s.Insert(context.Background(), shedding.Critical, v, nil) {
+				t.Errorf("%s: Insert(%q) = false", name, v)
+			}
+		}
+		if n := s.Len(); n != 2 {
+			t.Errorf("%s: Len() = %d, want 2", name, n)
+		}
+		if v, ok := s.Remove(); !ok || v != "a" {
+			t.Errorf("%s: Remove() = %q, %v, want a", name, v, ok)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		per     time.Duration // consumer's time per element
+		timeout time.Duration
+		err     error
+	}{
+		{"drains in time", 10 * time.Millisecond, 10 * time.Second, nil},
+		{"too slow", time.Hour, 50 * time.Millisecond, context.DeadlineExceeded},
+	} {
+		q := &Queue[int]{}
+		var cancelled sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			cancelled.Add(1)
+			q.Insert(context.Background(), shedding.Sheddable, i, cancelled.Done)
+		}
+		consumed, stop := make(chan int, 5), make(chan struct{})
+		go func() {
+			for {
+				v, err := q.RemoveWait(context.Background())
+				if err != nil {
+					return
+				}
+				consumed <- v
+				select {
+				case <-time.After(tc.per):
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+		if err := q.Shutdown(ctx); err != tc.err {
+			t.Errorf("%s: Shutdown() = %v, want %v", tc.name, err, tc.err)
+		}
+		cancel()
+		close(stop)
+		if q.Insert(context.Background(), shedding.Sheddable, -1, nil) {
+			t.Errorf("%s: Insert after Shutdown = true, want false", tc.name)
+		}
+		// Whatever wasn't consumed was cancelled
+		cancelled.Wait()
+		if tc.err == nil && len(consumed) != 5 {
+			t.Errorf("%s: consumed %d of 5 elements", tc.name, len(consumed))
+		}
+	}
+}
+
+func TestOrderLIFO(t *testing.T) {
+	q := &Queue[string]{}
+	q.Config.Order = OrderLIFO
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Insert(context.Background(), shedding.Sheddable, "s1", nil)
+	q.Insert(context.Background(), shedding.Critical, "c1", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "s2", nil)
+	q.Insert(context.Background(), shedding.Critical, "c2", nil)
+	q.Insert(ctx, shedding.Critical, "cancelled", nil)
+	q.Insert(ctx, shedding.Sheddable, "cancelled", nil)
+	cancel()
+
+	// Most critical first, newest first within each criticality
+	want := []string{"c2", "c1", "s2", "s1"}
+	if got := removeAll(q); !slices.Equal(got, want) {
+		t.Errorf("dequeued %q, want %q", got, want)
+	}
+}
+
+func TestLiveLen(t *testing.T) {
+	q := &Queue[string]{}
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	q.Insert(ctx, shedding.Sheddable, "cancelled", nil)
+	q.Insert(ctx, shedding.Sheddable, "cancelled", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+	cancel()
+
+	// Len may or may not have caught up with the cancellation yet, LiveLen has
+	if n := q.LiveLen(); n != 2 {
+		t.Errorf("LiveLen() = %d, want 2", n)
+	}
+	if n := q.Len(); n < 2 || n > 4 {
+		t.Errorf("Len() = %d, want between 2 and 4", n)
+	}
+}
+
+type valueKey struct{}
+
+func TestRemoveCtx(t *testing.T) {
+	q := &Queue[string]{}
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.WithValue(context.Background(), valueKey{}, "trace"), deadline)
+	defer cancel()
+	q.Insert(ctx, shedding.Sheddable, "a", nil)
+
+	got, v, ok := q.RemoveCtx()
+	if !ok || v != "a" {
+		t.Fatalf("RemoveCtx() = %q, %v, want a", v, ok)
+	}
+	if d, ok := got.Deadline(); !ok || !d.Equal(deadline) {
+		t.Errorf("returned context has deadline %v, %v, want %v", d, ok, deadline)
+	}
+	if got.Value(valueKey{}) != "trace" {
+		t.Error("returned context lost the inserted context's values")
+	}
+	if _, _, ok := q.RemoveCtx(); ok {
+		t.Error("RemoveCtx() of an empty queue returned an element")
+	}
+}
+
+func TestNoDeadlineNever(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	for i := 0; i < 10; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, "forever", nil)
+	}
+	mc.Add(time.Hour)
+	if n := len(removeAll(q)); n != 10 {
+		t.Errorf("%d elements without deadlines survived an hour, want all 10", n)
+	}
+}
+
+func TestNoDeadlineTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{0, time.Minute, time.Hour} {
+		q, mc := newTimedQueue(t, time.Millisecond)
+		q.Config.NoDeadlinePolicy = NoDeadlineTTL
+		q.Config.DefaultTTL = ttl
+		q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+		if n := q.Len(); n != 1 {
+			t.Errorf("DefaultTTL=%v: Len() = %d straight after Insert, want 1", ttl, n)
+		}
+
+		mc.Add(2 * time.Minute)
+		want := 0
+		if ttl == time.Hour {
+			want = 1
+		}
+		if n := len(removeAll(q)); n != want {
+			t.Errorf("DefaultTTL=%v: %d elements left after two minutes, want %d", ttl, n, want)
+		}
+	}
+}
+
+func TestShedConcurrent(t *testing.T) {
+	q := &Queue[int]{}
+	var cancels []context.CancelFunc
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		q.Insert(ctx, shedding.Sheddable, i, nil)
+	}
+
+	// Each element is returned by at most one of the calls, or shed in the
+	// background when its context is done
+	var mu sync.Mutex
+	seen := map[int]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for _, cancel := range cancels[i*25 : (i+1)*25] {
+				cancel()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for _, v := range q.Shed() {
+					mu.Lock()
+					if seen[v] {
+						t.Errorf("%d returned by Shed twice", v)
+					}
+					seen[v] = true
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if _, ok := q.Peek(); ok {
+		t.Error("elements left after every context was cancelled")
+	}
+}
+
+func TestWaitUntilEmpty(t *testing.T) {
+	mc := clock.NewMock()
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	if err := q.WaitUntilEmpty(context.Background()); err != nil {
+		t.Errorf("WaitUntilEmpty() of an empty queue = %v", err)
+	}
+
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.WaitUntilEmpty(ctx); err != context.DeadlineExceeded {
+		t.Errorf("WaitUntilEmpty() of a non-empty queue = %v, want DeadlineExceeded", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- q.WaitUntilEmpty(context.Background()) }()
+	q.Remove()
+	select {
+	case err := <-done:
+		t.Fatalf("WaitUntilEmpty() = %v with an element left", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	q.Remove()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WaitUntilEmpty() = %v once drained", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("WaitUntilEmpty() didn't return once the queue was drained")
+	}
+}
+
+func TestDeadlinePassedBeforeErr(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	var reasons []ShedReason
+	q.Config.OnShed = func(_ shedding.Criticality, _ string, reason ShedReason) {
+		reasons = append(reasons, reason)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Minute))
+	defer cancel()
+	q.Insert(ctx, shedding.Critical, "a", nil)
+
+	// The context's timer is on the real clock, so Err lags the mock clock
+	mc.Add(2 * time.Minute)
+	if ctx.Err() != nil {
+		t.Fatal("context expired on the real clock")
+	}
+	if _, ok := q.Peek(); ok {
+		t.Error("element past its deadline by the queue's clock was kept")
+	}
+	if !slices.Equal(reasons, []ShedReason{ShedDeadline}) {
+		t.Errorf("shed with reasons %v, want one for deadline", reasons)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	q := &Queue[int]{}
+	q.Config.MaxLen = 1
+	q.Config.DeadLetterSize = 3
+	if got := q.DeadLetter(); len(got) != 0 {
+		t.Errorf("DeadLetter() = %v before anything was shed", got)
+	}
+	// Each insert into the full queue sheds the new element
+	q.Insert(context.Background(), shedding.Critical, 0, nil)
+	for i := 1; i <= 5; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, i, nil)
+	}
+	if got := q.DeadLetter(); !slices.Equal(got, []int{3, 4, 5}) {
+		t.Errorf("DeadLetter() = %v after shedding 1 to 5, want the last three, newest last", got)
+	}
+	q.Clear()
+	if got := q.DeadLetter(); !slices.Equal(got, []int{3, 4, 5}) {
+		t.Errorf("DeadLetter() = %v after Clear, want it unchanged, since Clear doesn't shed", got)
+	}
+}
+
+func TestDropProbability(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		q := &Queue[int]{}
+		q.Config.Rand = rand.New(rand.NewPCG(1, 2))
+		q.Config.DryRun = dryRun
+		q.Config.DropProbability = func(crit shedding.Criticality, _ float64) float64 {
+			if crit == shedding.Sheddable {
+				return 0.1
+			}
+			return 0
+		}
+		const n = 4000
+		dropped := 0
+		for i := 0; i < n; i++ {
+			if !q.Insert(context.Background(), shedding.Sheddable, i, nil) {
+				dropped++
+			}
+			q.Insert(context.Background(), shedding.Critical, i, nil)
+			// Keep the queue short, for speed
+			removeAll(q)
+		}
+
+		s := q.Stats()
+		if dryRun {
+			if dropped != 0 || s.Removed != 2*n {
+				t.Errorf("DryRun: %d dropped, %d removed, want none dropped", dropped, s.Removed)
+			}
+			dropped = int(s.WouldShed)
+		} else if got := s.ShedByReason[ShedProbability]; got != uint64(dropped) {
+			t.Errorf("ShedByReason[ShedProbability] = %d, want %d", got, dropped)
+		}
+		if dropped < n*8/100 || dropped > n*12/100 {
+			t.Errorf("DryRun=%v: %d of %d sheddable elements dropped, want about 10%%", dryRun, dropped, n)
+		}
+	}
+}
+
+func TestConsume(t *testing.T) {
+	q := &Queue[string]{}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	q.Insert(cancelled, shedding.Sheddable, "shed", nil)
+	q.InsertBatch(context.Background(), shedding.Sheddable, []string{"b", "c"}, nil)
+	q.Insert(context.Background(), shedding.Sheddable, "d", nil)
+	go func() {
+		q.WaitUntilEmpty(context.Background())
+		q.Close()
+	}()
+
+	var got []string
+	for v := range q.Consume(context.Background()) {
+		got = append(got, v)
+	}
+	if want := []string{"a", "b", "c", "d"}; !slices.Equal(got, want) {
+		t.Errorf("Consume() produced %q, want %q", got, want)
+	}
+}
+
+func TestRemoveFunc(t *testing.T) {
+	q := &Queue[int]{}
+	q.Config.MaxLen = 8
+	// Wrap the ring around before removing from it
+	for i := 0; i < 5; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, -1, nil)
+		q.Remove()
+	}
+	for i := 0; i < 8; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, i, nil)
+	}
+
+	if n := q.RemoveFunc(func(_ shedding.Criticality, v int) bool { return v%3 == 0 }); n != 3 {
+		t.Errorf("RemoveFunc() = %d, want 3", n)
+	}
+	if n := q.Len(); n != 5 {
+		t.Errorf("Len() = %d, want 5", n)
+	}
+	q.Insert(context.Background(), shedding.Sheddable, 8, nil)
+	want := []int{1, 2, 4, 5, 7, 8}
+	if got := removeAll(q); !slices.Equal(got, want) {
+		t.Errorf("remaining elements = %v, want %v", got, want)
+	}
+}
+
+func TestInsertKeyedDuplicate(t *testing.T) {
+	q := &Queue[string]{}
+	var shed []string
+	q.Config.OnShed = func(_ shedding.Criticality, v string, reason ShedReason) {
+		if reason == ShedDuplicate {
+			shed = append(shed, v)
+		}
+	}
+	if !q.InsertKeyed(context.Background(), shedding.Sheddable, "k", "first", nil) {
+		t.Fatal("first InsertKeyed was rejected")
+	}
+	if q.InsertKeyed(context.Background(), shedding.Sheddable, "k", "retry", nil) {
+		t.Error("duplicate InsertKeyed was accepted")
+	}
+	q.InsertKeyed(context.Background(), shedding.Sheddable, "", "unkeyed", nil)
+	q.InsertKeyed(context.Background(), shedding.Sheddable, "", "unkeyed", nil)
+	if got := removeAll(q); !slices.Equal(got, []string{"first", "unkeyed", "unkeyed"}) {
+		t.Errorf("queue holds %q", got)
+	}
+	if !slices.Equal(shed, []string{"retry"}) {
+		t.Errorf("shed as duplicates: %q, want [retry]", shed)
+	}
+
+	// Once the first has been dequeued, the key is free again
+	if !q.InsertKeyed(context.Background(), shedding.Sheddable, "k", "later", nil) {
+		t.Error("InsertKeyed after the first was dequeued was rejected")
+	}
+}
+
+func TestInsertWait(t *testing.T) {
+	q := &Queue[string]{}
+	q.Config.MaxLen = 1
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.InsertWait(ctx, shedding.Critical, "timed out", nil); err != context.DeadlineExceeded {
+		t.Errorf("InsertWait() into a full queue = %v, want DeadlineExceeded", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- q.InsertWait(context.Background(), shedding.Critical, "b", nil) }()
+	select {
+	case err := <-done:
+		t.Fatalf("InsertWait() = %v while the queue was full, want it to block", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if v, _ := q.Remove(); v != "a" {
+		t.Errorf("Remove() = %q, want a, which InsertWait mustn't shed", v)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("InsertWait() = %v once there was room", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("InsertWait() still blocked after a Remove")
+	}
+	if got := removeAll(q); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("queue holds %q, want [b]", got)
+	}
+}
+
+// emptied reports whether q's storage holds no references to removed elements
+func emptied[T any](q *Queue[T]) bool {
+	for _, e := range q.l.buf {
+		if e.ctx != nil || e.cancel != nil || e.unwatch != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRemoveSingle(t *testing.T) {
+	q := &Queue[string]{}
+	q.Insert(context.Background(), shedding.Sheddable, "only", func() {})
+	if v, ok := q.Remove(); !ok || v != "only" {
+		t.Fatalf("Remove() = %q, %v", v, ok)
+	}
+	if !emptied(q) {
+		t.Error("the only element is still referenced after Remove")
+	}
+
+	// The only element is shed by the pass in Remove, before it can be popped
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Insert(ctx, shedding.Sheddable, "shed", nil)
+	cancel()
+	if v, ok := q.Remove(); ok {
+		t.Errorf("Remove() = %q from a queue whose only element was cancelled", v)
+	}
+	if !emptied(q) {
+		t.Error("the shed element is still referenced")
+	}
+}
+
+func TestDrainedQueueKeepsNoReferences(t *testing.T) {
+	q := &Queue[*[1 << 10]byte]{}
+	collected := make(chan struct{}, 100)
+	insert := func(ctx context.Context) {
+		v := new([1 << 10]byte)
+		runtime.SetFinalizer(v, func(*[1 << 10]byte) { collected <- struct{}{} })
+		q.Insert(ctx, shedding.Sheddable, v, nil)
+	}
+	for i := 0; i < 20; i++ {
+		insert(context.Background())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 10; i++ {
+		insert(ctx)
+	}
+	cancel()
+	q.RemoveN(5)
+	q.Remove()
+	q.RemoveFunc(func(_ shedding.Criticality, v *[1 << 10]byte) bool { return v[0] == 0 })
+	if n := q.Len(); n != 0 {
+		t.Fatalf("Len() = %d after draining", n)
+	}
+	if !emptied(q) {
+		t.Error("drained queue still references removed elements")
+	}
+
+	for n, deadline := 0, time.Now().Add(10*time.Second); n < 30; {
+		runtime.GC()
+		select {
+		case <-collected:
+			n++
+		case <-time.After(10 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatalf("only %d of 30 elements were collected after draining", n)
+			}
+		}
+	}
+}
+
+// BenchmarkInsertDepth measures inserting into and removing from a queue
+// holding 50k elements with cancellable contexts, and reports how many
+// goroutines the queue keeps for them
+func BenchmarkInsertDepth(b *testing.B) {
+	const depth = 50000
+	q := &Queue[int]{}
+	defer q.Close()
+	before := settledGoroutines()
+	for i := 0; i < depth; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		q.Insert(ctx, 0, i, cancel)
+	}
+	goroutines := settledGoroutines() - before
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		q.Insert(ctx, 0, i, cancel)
+		q.Remove()
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(goroutines), "goroutines")
+}
+
+func TestRequeue(t *testing.T) {
+	for _, order := range []Order{OrderFIFO, OrderEDF, OrderLIFO} {
+		mc := clock.NewMock()
+		mc.Set(time.Now())
+		q := &Queue[string]{}
+		q.Config.Clock = mc
+		q.Config.Order = order
+		ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Hour))
+		defer cancel()
+		for _, v := range []string{"a", "b", "c"} {
+			q.Insert(ctx, shedding.Sheddable, v, nil)
+		}
+
+		ctx, v, ok := q.RemoveCtx()
+		if !ok {
+			t.Fatalf("%v: queue empty", order)
+		}
+		if !q.Requeue(ctx, shedding.Sheddable, v, nil) {
+			t.Fatalf("%v: Requeue(%q) was rejected", order, v)
+		}
+		if got, _ := q.Remove(); got != v {
+			t.Errorf("%v: Remove after Requeue(%q) = %q", order, v, got)
+		}
+	}
+}
+
+func TestRequeueKeepsDeadline(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Minute))
+	defer cancel()
+	q.Insert(ctx, shedding.Sheddable, "a", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+
+	ctx, v, _ := q.RemoveCtx()
+	mc.Add(time.Hour)
+	q.Requeue(ctx, shedding.Sheddable, v, cancel)
+	if got := removeAll(q); len(got) != 1 || got[0] != "b" {
+		t.Errorf("requeued element past its deadline was not shed: got %q", got)
+	}
+}
+
+func TestInsertShedsBeforeReturning(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	var shed []string
+	q.Config.OnShed = func(_ shedding.Criticality, v string, _ ShedReason) {
+		shed = append(shed, v)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.Insert(ctx, shedding.Sheddable, "cancelled", nil)
+	past, cancel := context.WithDeadline(context.Background(), mc.Now().Add(-time.Second))
+	defer cancel()
+	q.Insert(past, shedding.Sheddable, "late", nil)
+	q.InsertBatch(ctx, shedding.Sheddable, []string{"batch"}, nil)
+
+	if n := q.Len(); n != 0 {
+		t.Errorf("Len() = %d straight after inserting expired elements, want 0", n)
+	}
+	if len(shed) != 3 {
+		t.Errorf("OnShed got %q, want all three elements", shed)
+	}
+}
+
+func TestDiscardReported(t *testing.T) {
+	q := &Queue[string]{}
+	var discarded []string
+	q.Config.OnDiscard = func(_ shedding.Criticality, v string) {
+		discarded = append(discarded, v)
+	}
+	cancelled := 0
+	for _, v := range []string{"a", "b", "c"} {
+		q.Insert(context.Background(), shedding.Sheddable, v, func() { cancelled++ })
+	}
+
+	if n := q.RemoveFunc(func(_ shedding.Criticality, v string) bool { return v == "b" }); n != 1 {
+		t.Errorf("RemoveFunc() = %d, want 1", n)
+	}
+	q.Clear()
+	if len(discarded) != 3 || discarded[0] != "b" {
+		t.Errorf("OnDiscard got %q, want b then a and c", discarded)
+	}
+	if cancelled != 3 {
+		t.Errorf("%d cancel functions called, want 3", cancelled)
+	}
+}
+
+func TestInsertKeyedReplace(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config Config[string]
+	}{
+		{"unlimited", Config[string]{}},
+		{"MaxLen", Config[string]{MaxLen: 2}},
+		{"Quotas", Config[string]{Quotas: map[shedding.Criticality]int{shedding.Sheddable: 1}}},
+	} {
+		q := &Queue[string]{Config: tc.config}
+		q.Config.ReplaceDuplicates = true
+		var shed []string
+		q.Config.OnShed = func(_ shedding.Criticality, v string, _ ShedReason) {
+			shed = append(shed, v)
+		}
+		q.InsertKeyed(context.Background(), shedding.Sheddable, "k", "old", nil)
+		q.InsertKeyed(context.Background(), shedding.Critical, "", "other", nil)
+		if !q.InsertKeyed(context.Background(), shedding.Sheddable, "k", "new", nil) {
+			t.Errorf("%s: replacing InsertKeyed was rejected", tc.name)
+		}
+		if got := removeAll(q); !slices.Equal(got, []string{"other", "new"}) {
+			t.Errorf("%s: queue holds %q, want [other new]", tc.name, got)
+		}
+		if !slices.Equal(shed, []string{"old"}) {
+			t.Errorf("%s: shed %q, want [old]", tc.name, shed)
+		}
+	}
+
+	// The only element may be replaced in a queue of one
+	q := &Queue[string]{}
+	q.Config.MaxLen = 1
+	q.Config.ReplaceDuplicates = true
+	q.InsertKeyed(context.Background(), shedding.Sheddable, "k", "old", nil)
+	if !q.InsertKeyed(context.Background(), shedding.Sheddable, "k", "new", nil) {
+		t.Error("MaxLen 1: replacing InsertKeyed was rejected")
+	}
+	if got := removeAll(q); !slices.Equal(got, []string{"new"}) {
+		t.Errorf("MaxLen 1: queue holds %q, want [new]", got)
+	}
+}
+
+func TestNoDeadlineLowest(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	q.Config.MaxLen = 2
+	q.Config.NoDeadlinePolicy = NoDeadlineLowest
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Hour))
+	defer cancel()
+
+	q.Insert(context.Background(), shedding.CriticalPlus, "no deadline", nil)
+	q.Insert(ctx, shedding.Sheddable, "a", nil)
+	// A full queue makes room by evicting the element without a deadline,
+	// despite its criticality
+	if !q.Insert(ctx, shedding.Sheddable, "b", nil) {
+		t.Error("element with a deadline rejected from a full queue")
+	}
+	// and rejects another one, as the least critical of all
+	if q.Insert(context.Background(), shedding.CriticalPlus, "also no deadline", nil) {
+		t.Error("element without a deadline accepted into a full queue")
+	}
+	if got := removeAll(q); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("queue holds %q, want [a b]", got)
+	}
+}
+
+func TestConsumeStopKeepsElement(t *testing.T) {
+	q := &Queue[string]{}
+	cancelled := 0
+	q.Insert(context.Background(), shedding.Sheddable, "a", func() { cancelled++ })
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := q.Consume(ctx)
+	// Wait for "a" to be taken, to be handed over
+	for q.Len() == 2 {
+		runtime.Gosched()
+	}
+	cancel()
+	// Whether or not "a" was received before Consume stopped, it must not be
+	// lost
+	var got []string
+	for v := range ch {
+		got = append(got, v)
+	}
+	got = append(got, removeAll(q)...)
+	if !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("received and left in the queue %q, want [a b]", got)
+	}
+	if cancelled != 1 {
+		t.Errorf("cancel for a called %d times, want 1", cancelled)
+	}
+}
+
+func TestConsumeStopKeepsStats(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	var mu sync.Mutex
+	waited := map[string]time.Duration{}
+	q.Config.OnDequeue = func(_ shedding.Criticality, v string, d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		waited[v] = d
+	}
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := q.Consume(ctx)
+	if v := <-ch; v != "a" {
+		t.Fatalf("Consume() produced %q, want a", v)
+	}
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+	// Once the queue is empty, "b" is waiting to be received
+	q.WaitUntilEmpty(context.Background())
+	mc.Add(time.Second)
+	cancel()
+	// Nothing receives "b", so it is put back
+	if v, err := q.RemoveWait(context.Background()); v != "b" || err != nil {
+		t.Fatalf("RemoveWait() = %q, %v, want b, nil", v, err)
+	}
+	for v := range ch {
+		t.Errorf("Consume() produced %q after it was stopped", v)
+	}
+
+	if s := q.Stats(); s.Inserted != 2 || s.Removed != 2 || s.Shed != 0 {
+		t.Errorf("Stats() = %d inserted, %d removed, %d shed, want 2, 2, 0", s.Inserted, s.Removed, s.Shed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]time.Duration{"a": 0, "b": time.Second}
+	if !maps.Equal(waited, want) {
+		t.Errorf("OnDequeue reported waits %v, want %v", waited, want)
+	}
+}
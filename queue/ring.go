@@ -0,0 +1,155 @@
+package queue
+
+import "iter"
+
+// ring is a FIFO in a circular buffer, which grows by doubling. Pushing and
+// popping are amortised O(1); removing from the middle shifts the shorter end.
+// Every operation which vacates a slot zeroes it, including when the last
+// element is removed, so that the buffer doesn't keep removed elements, and
+// the contexts and cancel functions they hold, reachable.
+type ring[T any] struct {
+	buf  []T
+	head int // index in buf of the first element
+	n    int // number of elements
+}
+
+func (r *ring[T]) len() int {
+	return r.n
+}
+
+// index returns the position in buf of the i'th element
+func (r *ring[T]) index(i int) int {
+	return (r.head + i) % len(r.buf)
+}
+
+func (r *ring[T]) at(i int) T {
+	return r.buf[r.index(i)]
+}
+
+func (r *ring[T]) set(i int, v T) {
+	r.buf[r.index(i)] = v
+}
+
+// all iterates over the elements in order
+func (r *ring[T]) all() iter.Seq2[int, T] {
+	return func(yield func(int, T) bool) {
+		for i := 0; i < r.n; i++ {
+			if !yield(i, r.buf[r.index(i)]) {
+				return
+			}
+		}
+	}
+}
+
+// segments returns the elements in order, as two slices of the buffer
+func (r *ring[T]) segments() (a, b []T) {
+	if r.head+r.n <= len(r.buf) {
+		return r.buf[r.head : r.head+r.n], nil
+	}
+	return r.buf[r.head:], r.buf[:r.head+r.n-len(r.buf)]
+}
+
+func (r *ring[T]) grow() {
+	if r.n < len(r.buf) {
+		return
+	}
+	buf := make([]T, max(2*len(r.buf), 8))
+	for i, v := range r.all() {
+		buf[i] = v
+	}
+	r.buf = buf
+	r.head = 0
+}
+
+// reserve grows the buffer to hold at least n elements without growing again
+func (r *ring[T]) reserve(n int) {
+	if n <= len(r.buf) {
+		return
+	}
+	buf := make([]T, n)
+	for i, v := range r.all() {
+		buf[i] = v
+	}
+	r.buf = buf
+	r.head = 0
+}
+
+func (r *ring[T]) pushBack(v T) {
+	r.grow()
+	r.buf[r.index(r.n)] = v
+	r.n++
+}
+
+// insertAt inserts v so that it becomes the i'th element
+func (r *ring[T]) insertAt(i int, v T) {
+	r.grow()
+	if i < r.n/2 {
+		// Shift the elements before i backwards
+		r.head = (r.head + len(r.buf) - 1) % len(r.buf)
+		for j := 0; j < i; j++ {
+			r.buf[r.index(j)] = r.buf[r.index(j+1)]
+		}
+	} else {
+		// Shift the elements from i onwards forwards
+		for j := r.n; j > i; j-- {
+			r.buf[r.index(j)] = r.buf[r.index(j-1)]
+		}
+	}
+	r.buf[r.index(i)] = v
+	r.n++
+}
+
+// popFront removes and returns the first element. r must not be empty.
+func (r *ring[T]) popFront() T {
+	var zero T
+	v := r.buf[r.head]
+	r.buf[r.head] = zero
+	r.head = (r.head + 1) % len(r.buf)
+	r.n--
+	return v
+}
+
+// removeAt removes the i'th element
+func (r *ring[T]) removeAt(i int) {
+	var zero T
+	if i < r.n/2 {
+		// Shift the elements before i forwards
+		for j := i; j > 0; j-- {
+			r.buf[r.index(j)] = r.buf[r.index(j-1)]
+		}
+		r.buf[r.head] = zero
+		r.head = (r.head + 1) % len(r.buf)
+	} else {
+		// Shift the elements after i backwards
+		for j := i; j < r.n-1; j++ {
+			r.buf[r.index(j)] = r.buf[r.index(j+1)]
+		}
+		r.buf[r.index(r.n-1)] = zero
+	}
+	r.n--
+}
+
+// filter removes the elements for which keep returns false, preserving order.
+// keep is called once for each element, with its index before filtering.
+func (r *ring[T]) filter(keep func(i int, v T) bool) {
+	var zero T
+	n := 0
+	for i := 0; i < r.n; i++ {
+		v := r.buf[r.index(i)]
+		if keep(i, v) {
+			r.buf[r.index(n)] = v
+			n++
+		}
+	}
+	for i := n; i < r.n; i++ {
+		r.buf[r.index(i)] = zero
+	}
+	r.n = n
+}
+
+// reset removes every element
+func (r *ring[T]) reset() {
+	clear(r.buf)
+	r.head = 0
+	r.n = 0
+}
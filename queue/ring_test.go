@@ -0,0 +1,251 @@
+package queue
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/asuffield/shedding"
+)
+
+// stored stands in for an element, keyed on deadline
+type stored struct {
+	deadline int64
+	weight   float64
+}
+
+// deadlineHeap is the alternative to ring that BenchmarkStorage compares
+type deadlineHeap []stored
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].deadline < h[j].deadline }
+func (h deadlineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *deadlineHeap) Push(x any)        { *h = append(*h, x.(stored)) }
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	v := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return v
+}
+
+// BenchmarkStorage compares ring with a heap at each of the operations the
+// queue needs: dequeue the next element and insert a new one, remove one from
+// the middle, as the shed pass and RemoveFunc do, and walk every element in
+// dequeue order, as the shed pass does to project their waits. A heap is
+// only ordered at its root, so the walk has to sort a copy of it first.
+func BenchmarkStorage(b *testing.B) {
+	for _, depth := range []int{1000, 100000} {
+		r := rand.New(rand.NewPCG(1, 2))
+		deadlines := make([]int64, depth)
+		for i := range deadlines {
+			deadlines[i] = r.Int64()
+		}
+		slices.Sort(deadlines)
+		positions := make([]int, depth)
+		for i := range positions {
+			positions[i] = r.IntN(depth)
+		}
+		newRing := func() *ring[stored] {
+			var l ring[stored]
+			for _, d := range deadlines {
+				l.pushBack(stored{d, 1})
+			}
+			return &l
+		}
+		newHeap := func() *deadlineHeap {
+			// Built from the sorted deadlines, a heap would be sorted too, which
+			// it doesn't stay once elements come and go
+			h := make(deadlineHeap, 0, depth+1)
+			for _, i := range r.Perm(depth) {
+				h = append(h, stored{deadlines[i], 1})
+			}
+			heap.Init(&h)
+			return &h
+		}
+
+		b.Run(fmt.Sprintf("pop/ring/%d", depth), func(b *testing.B) {
+			l := newRing()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.popFront()
+				l.pushBack(stored{deadlines[i%depth], 1})
+			}
+		})
+		b.Run(fmt.Sprintf("pop/heap/%d", depth), func(b *testing.B) {
+			h := newHeap()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				heap.Pop(h)
+				heap.Push(h, stored{deadlines[i%depth], 1})
+			}
+		})
+
+		b.Run(fmt.Sprintf("remove/ring/%d", depth), func(b *testing.B) {
+			l := newRing()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.removeAt(positions[i%depth])
+				l.pushBack(stored{deadlines[i%depth], 1})
+			}
+		})
+		b.Run(fmt.Sprintf("remove/heap/%d", depth), func(b *testing.B) {
+			h := newHeap()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				heap.Remove(h, positions[i%depth])
+				heap.Push(h, stored{deadlines[i%depth], 1})
+			}
+		})
+
+		b.Run(fmt.Sprintf("walk/ring/%d", depth), func(b *testing.B) {
+			l := newRing()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ahead := 0.0
+				for _, e := range l.all() {
+					ahead += e.weight
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("walk/heap/%d", depth), func(b *testing.B) {
+			h := newHeap()
+			var sorted []stored
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sorted = append(sorted[:0], *h...)
+				slices.SortFunc(sorted, func(a, b stored) int { return cmp.Compare(a.deadline, b.deadline) })
+				ahead := 0.0
+				for _, e := range sorted {
+					ahead += e.weight
+				}
+			}
+		})
+	}
+}
+
+func TestRingInsertRemove(t *testing.T) {
+	var r ring[int]
+	// Wrap the ring around, so that pushes and removes have to cross the end
+	for i := 0; i < 6; i++ {
+		r.pushBack(-1)
+	}
+	for i := 0; i < 6; i++ {
+		r.popFront()
+	}
+	for i := 0; i < 7; i++ {
+		r.pushBack(i)
+	}
+	r.removeAt(1)
+	r.removeAt(4)
+	r.filter(func(_ int, v int) bool { return v != 3 })
+	want := []int{0, 2, 4, 6}
+	var got []int
+	for _, v := range r.all() {
+		got = append(got, v)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ring holds %v, want %v", got, want)
+	}
+	if r.popFront() != 0 || r.len() != 3 {
+		t.Errorf("after popFront, ring holds %d elements", r.len())
+	}
+}
+
+// BenchmarkDequeue compares ring with the slice it replaced, which shifted
+// every remaining element down on each dequeue
+func BenchmarkDequeue(b *testing.B) {
+	const depth = 10000
+	b.Run("ring", func(b *testing.B) {
+		var l ring[int]
+		for i := 0; i < depth; i++ {
+			l.pushBack(i)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			l.pushBack(l.popFront())
+		}
+	})
+
+	b.Run("slice", func(b *testing.B) {
+		l := make([]int, depth)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			e := l[0]
+			copy(l, l[1:])
+			l[len(l)-1] = e
+		}
+	})
+}
+
+// BenchmarkBurst measures a burst of 10k inserts into an empty queue, with and
+// without Grow beforehand
+func BenchmarkBurst(b *testing.B) {
+	const burst = 10000
+	for _, grow := range []bool{false, true} {
+		b.Run(fmt.Sprintf("grow=%v", grow), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				q := &Queue[int]{}
+				if grow {
+					q.Grow(burst)
+				}
+				q.InsertBatch(context.Background(), shedding.Sheddable, make([]int, burst), nil)
+			}
+		})
+	}
+}
+
+func TestGrow(t *testing.T) {
+	q := &Queue[int]{}
+	// Wrap the ring around before growing it
+	for i := 0; i < 8; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, i, nil)
+	}
+	q.RemoveN(5)
+	for i := 8; i < 11; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, i, nil)
+	}
+	q.Grow(100)
+	if c := len(q.l.buf); c < q.l.len()+100 {
+		t.Errorf("capacity %d after Grow(100) with %d queued, want at least %d", c, q.l.len(), q.l.len()+100)
+	}
+	got := removeAll(q)
+	if want := []int{5, 6, 7, 8, 9, 10}; !slices.Equal(got, want) {
+		t.Errorf("dequeued %v after Grow, want %v", got, want)
+	}
+}
+
+// zeroed reports whether every slot of r's buffer is the zero value
+func zeroed[T comparable](r *ring[T]) bool {
+	var zero T
+	for _, v := range r.buf {
+		if v != zero {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRingZeroesVacatedSlots(t *testing.T) {
+	var r ring[*int]
+	r.pushBack(new(int))
+	r.popFront()
+	if !zeroed(&r) {
+		t.Error("popFront of the only element left it in the buffer")
+	}
+
+	for i := 0; i < 5; i++ {
+		r.pushBack(new(int))
+	}
+	r.removeAt(1)
+	r.removeAt(3)
+	r.filter(func(i int, _ *int) bool { return i == 0 })
+	r.removeAt(0)
+	if !zeroed(&r) {
+		t.Error("removeAt and filter left removed elements in the buffer")
+	}
+}
@@ -0,0 +1,153 @@
+package queue
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/asuffield/shedding"
+)
+
+// QueueStats is a snapshot of the state of a Queue
+type QueueStats struct {
+	Len           int
+	ByCriticality map[shedding.Criticality]int // number of queued elements of each criticality
+	ExpectedWait  time.Duration                // current estimate of the wait per item
+	WarmingUp     bool                         // whether there are too few samples for an estimate yet, see IsWarmingUp
+	Throughput    float64                      // dequeues per second implied by ExpectedWait
+	LastDequeue   time.Time
+	OldestAge     time.Duration // how long the oldest live element has been queued
+
+	// Totals over the lifetime of the queue. Inserted counts every insert before
+	// the queue was closed, including those which were rejected and so are
+	// also counted as Shed.
+	Inserted uint64
+	Removed  uint64
+	Shed     uint64
+
+	// ShedByReason breaks Shed down by reason. ShedCancelled usually means
+	// callers are timing out upstream, ShedDeadline that the queue is
+	// overloaded, and ShedCapacity and ShedQuota that the limits are too tight.
+	ShedByReason map[ShedReason]uint64
+
+	// HighCritSaved counts the times an element that was projected to miss its
+	// deadline was kept by shedding less critical elements ahead of it instead.
+	// It is only counted by the default ShedPolicy.
+	HighCritSaved uint64
+
+	// WouldShed counts the elements which would have been shed, with DryRun
+	WouldShed uint64
+
+	// Percentiles of how long dequeued elements spent in the queue, over the
+	// lifetime of the queue and accurate to about 10%. This is the latency
+	// that shedding protects.
+	WaitP50, WaitP95, WaitP99 time.Duration
+}
+
+// Stats returns a snapshot of the queue. Unlike most methods, it does not shed
+// or update the wait estimate first.
+func (q *Queue[T]) Stats() QueueStats {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.Config.defaults()
+	return q.stats()
+}
+
+// reportStats queues a call to OnStats, if StatsInterval has passed since the
+// last one. Must be called with q.mux held.
+func (q *Queue[T]) reportStats() {
+	q.Config.defaults()
+	now := q.Config.Clock.Now()
+	if !q.lastStats.IsZero() && now.Sub(q.lastStats) < q.Config.StatsInterval {
+		return
+	}
+	q.lastStats = now
+	f, s := q.Config.OnStats, q.stats()
+	q.notify = append(q.notify, func() { f(s) })
+}
+
+// stats implements Stats. Must be called with q.mux held.
+func (q *Queue[T]) stats() QueueStats {
+	s := QueueStats{
+		Len:           q.l.len(),
+		ByCriticality: map[shedding.Criticality]int{},
+		ExpectedWait:  q.expectedWait,
+		WarmingUp:     q.warmingUp(),
+		Throughput:    throughput(q.expectedWait),
+		LastDequeue:   q.lastDequeue,
+		Inserted:      q.nInserted,
+		Removed:       q.nRemoved,
+		Shed:          q.nShed,
+		HighCritSaved: q.nSaved,
+		WouldShed:     q.nWouldShed,
+		ShedByReason:  map[ShedReason]uint64{},
+		WaitP50:       q.waits.percentile(0.5),
+		WaitP95:       q.waits.percentile(0.95),
+		WaitP99:       q.waits.percentile(0.99),
+	}
+	for r, n := range q.nShedBy {
+		s.ShedByReason[r] = n
+	}
+	now := q.Config.Clock.Now()
+	for _, e := range q.l.all() {
+		s.ByCriticality[e.crit]++
+		if e.ctx.Err() == nil {
+			s.OldestAge = max(s.OldestAge, now.Sub(e.enqueued))
+		}
+	}
+	return s
+}
+
+// DebugSnapshot is a dump of the state of a Queue, for debugging endpoints,
+// which can be marshalled with encoding/json
+type DebugSnapshot struct {
+	Len           int            `json:"len"`
+	ByCriticality map[string]int `json:"by_criticality"`
+	ExpectedWait  time.Duration  `json:"expected_wait"`
+	LastDequeue   time.Time      `json:"last_dequeue"`
+	Elements      []DebugElement `json:"elements"` // in dequeue order
+}
+
+// DebugElement describes a single element in a DebugSnapshot
+type DebugElement struct {
+	Criticality string        `json:"criticality"`
+	Age         time.Duration `json:"age"`
+	Deadline    *time.Time    `json:"deadline,omitempty"`
+	// Value is only included if it implements json.Marshaler
+	Value json.RawMessage `json:"value,omitempty"`
+	Live  bool            `json:"live"` // false if the element's context is done
+}
+
+// DebugSnapshot returns a dump of the queue. Like Stats, it does not shed or
+// update the wait estimate.
+func (q *Queue[T]) DebugSnapshot() DebugSnapshot {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.Config.defaults()
+
+	s := DebugSnapshot{
+		Len:           q.l.len(),
+		ByCriticality: map[string]int{},
+		ExpectedWait:  q.expectedWait,
+		LastDequeue:   q.lastDequeue,
+		Elements:      make([]DebugElement, 0, q.l.len()),
+	}
+	now := q.Config.Clock.Now()
+	for _, e := range q.l.all() {
+		s.ByCriticality[e.crit.String()]++
+		d := DebugElement{
+			Criticality: e.crit.String(),
+			Age:         now.Sub(e.enqueued),
+			Live:        e.ctx.Err() == nil,
+		}
+		if at, ok := e.deadline(); ok {
+			d.Deadline = &at
+		}
+		if m, ok := any(e.v).(json.Marshaler); ok {
+			if b, err := m.MarshalJSON(); err == nil {
+				d.Value = b
+			}
+		}
+		s.Elements = append(s.Elements, d)
+	}
+	return s
+}
@@ -0,0 +1,240 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/benbjohnson/clock"
+)
+
+func TestStats(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	q.Config.MaxLen = 2
+
+	q.Insert(context.Background(), shedding.Sheddable, "shed", nil)
+	q.Insert(context.Background(), shedding.Critical, "removed", nil)
+	q.Insert(context.Background(), shedding.CriticalPlus, "queued", nil)
+	mc.Add(time.Second)
+	if v, ok := q.Remove(); !ok || v != "removed" {
+		t.Fatalf("Remove() = %q, %v, want removed", v, ok)
+	}
+	mc.Add(time.Second)
+
+	s := q.Stats()
+	if s.Len != 1 || !maps.Equal(s.ByCriticality, map[shedding.Criticality]int{shedding.CriticalPlus: 1}) {
+		t.Errorf("Len = %d, ByCriticality = %v, want the CriticalPlus element only", s.Len, s.ByCriticality)
+	}
+	if s.Inserted != 3 || s.Removed != 1 || s.Shed != 1 {
+		t.Errorf("Inserted, Removed, Shed = %d, %d, %d, want 3, 1, 1", s.Inserted, s.Removed, s.Shed)
+	}
+	if !maps.Equal(s.ShedByReason, map[ShedReason]uint64{ShedCapacity: 1}) {
+		t.Errorf("ShedByReason = %v, want one for capacity", s.ShedByReason)
+	}
+	if want := mc.Now().Add(-time.Second); !s.LastDequeue.Equal(want) {
+		t.Errorf("LastDequeue = %v, want %v", s.LastDequeue, want)
+	}
+	if s.OldestAge != 2*time.Second {
+		t.Errorf("OldestAge = %v, want 2s", s.OldestAge)
+	}
+
+	// Taking a snapshot changes nothing
+	if again := q.Stats(); !reflect.DeepEqual(again, s) {
+		t.Errorf("second Stats() = %+v, want %+v", again, s)
+	}
+}
+
+func TestHighCritSaved(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	later, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Hour))
+	defer cancel()
+	soon, cancel := context.WithDeadline(context.Background(), mc.Now().Add(2500*time.Millisecond))
+	defer cancel()
+
+	q.Insert(later, shedding.Sheddable, "first", nil)
+	q.Insert(later, shedding.Sheddable, "second", nil)
+	q.Insert(soon, shedding.Critical, "saved", nil)
+	if s := q.Stats(); s.HighCritSaved != 1 {
+		t.Errorf("HighCritSaved = %d after shedding second to save a critical element, want 1", s.HighCritSaved)
+	}
+
+	// Shedding the rest of what's less critical wouldn't be enough for this
+	// one, so it is shed instead
+	sooner, cancel := context.WithDeadline(context.Background(), mc.Now().Add(500*time.Millisecond))
+	defer cancel()
+	q.Insert(sooner, shedding.Critical, "lost", nil)
+	if s := q.Stats(); s.HighCritSaved != 1 || s.Shed != 2 || s.Len != 2 {
+		t.Errorf("HighCritSaved = %d, Shed = %d, Len = %d after an unsaveable element, want 1, 2 and 2", s.HighCritSaved, s.Shed, s.Len)
+	}
+}
+
+func TestShedByReason(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	q.Config.MaxLen = 2
+	q.Config.Quotas = map[shedding.Criticality]int{shedding.SheddablePlus: 0}
+	counts := func() map[ShedReason]uint64 {
+		q.Peek()
+		return q.Stats().ShedByReason
+	}
+	want := map[ShedReason]uint64{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Insert(ctx, shedding.Sheddable, "cancelled", nil)
+	cancel()
+	want[ShedCancelled]++
+	if got := counts(); !maps.Equal(got, want) {
+		t.Errorf("after a cancellation: ShedByReason = %v, want %v", got, want)
+	}
+
+	late, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Millisecond))
+	defer cancel()
+	q.Insert(late, shedding.Sheddable, "late", nil)
+	want[ShedDeadline]++
+	if got := counts(); !maps.Equal(got, want) {
+		t.Errorf("after a late element: ShedByReason = %v, want %v", got, want)
+	}
+
+	for _, v := range []string{"a", "b", "full"} {
+		q.Insert(context.Background(), shedding.Sheddable, v, nil)
+	}
+	want[ShedCapacity]++
+	if got := counts(); !maps.Equal(got, want) {
+		t.Errorf("after overfilling: ShedByReason = %v, want %v", got, want)
+	}
+
+	q.Insert(context.Background(), shedding.SheddablePlus, "over quota", nil)
+	want[ShedQuota]++
+	if got := counts(); !maps.Equal(got, want) {
+		t.Errorf("after exceeding a quota: ShedByReason = %v, want %v", got, want)
+	}
+}
+
+// marshalled is a queue value which implements json.Marshaler
+type marshalled string
+
+func (m marshalled) MarshalJSON() ([]byte, error) { return json.Marshal(string(m)) }
+
+func TestDebugSnapshot(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[marshalled]{}
+	q.Config.Clock = mc
+	deadline := mc.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	q.Insert(ctx, shedding.Critical, "a", nil)
+	mc.Add(time.Second)
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+
+	s := q.DebugSnapshot()
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got DebugSnapshot
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Len != 2 || !maps.Equal(got.ByCriticality, map[string]int{"CRITICAL": 1, "SHEDDABLE": 1}) {
+		t.Errorf("snapshot has Len %d and ByCriticality %v, want one CRITICAL and one SHEDDABLE", got.Len, got.ByCriticality)
+	}
+	if len(got.Elements) != 2 {
+		t.Fatalf("snapshot has %d elements, want 2", len(got.Elements))
+	}
+	first, second := got.Elements[0], got.Elements[1]
+	if first.Criticality != "CRITICAL" || first.Age != time.Second || first.Deadline == nil || !first.Deadline.Equal(deadline) || string(first.Value) != `"a"` || !first.Live {
+		t.Errorf("first element %+v, want CRITICAL, 1s old, with its deadline and value", first)
+	}
+	if second.Deadline != nil || second.Age != 0 || string(second.Value) != `"b"` {
+		t.Errorf("second element %+v, want no deadline and just inserted", second)
+	}
+	if q.Len() != 2 {
+		t.Error("DebugSnapshot changed the queue")
+	}
+}
+
+func TestStatsWarmingUp(t *testing.T) {
+	q := &Queue[string]{}
+	q.Config.TimingHistory = 4
+	q.Config.MinSamples = 2
+	for _, tc := range []struct {
+		samples int
+		warm    bool
+	}{
+		{0, true},
+		{1, true},
+		{2, false},
+		{4, false},
+	} {
+		q.ImportTiming(slices.Repeat([]time.Duration{time.Millisecond}, tc.samples))
+		if got, s := q.IsWarmingUp(), q.Stats(); got != tc.warm || s.WarmingUp != tc.warm {
+			t.Errorf("with %d samples: IsWarmingUp() = %v, Stats().WarmingUp = %v, want %v", tc.samples, got, s.WarmingUp, tc.warm)
+		}
+	}
+	q.ResetTiming()
+	if !q.IsWarmingUp() {
+		t.Error("IsWarmingUp() = false after ResetTiming")
+	}
+}
+
+func TestWaitPercentiles(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[int]{}
+	q.Config.Clock = mc
+	// Waits of 10ms, 20ms, ... 1s
+	for i := 0; i < 100; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, i, nil)
+	}
+	for i := 0; i < 100; i++ {
+		mc.Add(10 * time.Millisecond)
+		q.Remove()
+	}
+
+	s := q.Stats()
+	for _, tc := range []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{"WaitP50", s.WaitP50, 500 * time.Millisecond},
+		{"WaitP95", s.WaitP95, 950 * time.Millisecond},
+		{"WaitP99", s.WaitP99, 990 * time.Millisecond},
+	} {
+		if tc.got < tc.want*9/10 || tc.got > tc.want*11/10 {
+			t.Errorf("%s = %v, want within 10%% of %v", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestOnStats(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	var reports []QueueStats
+	q.Config.OnStats = func(s QueueStats) { reports = append(reports, s) }
+
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	q.Insert(context.Background(), shedding.Critical, "b", nil)
+	q.Insert(context.Background(), shedding.Critical, "c", nil)
+	if len(reports) != 1 {
+		t.Fatalf("OnStats called %d times within a StatsInterval, want once", len(reports))
+	}
+	mc.Add(time.Second)
+	q.Remove()
+	if len(reports) != 2 {
+		t.Fatalf("OnStats called %d times, want twice after a StatsInterval", len(reports))
+	}
+	want := map[shedding.Criticality]int{shedding.Critical: 2}
+	if got := reports[1].ByCriticality; !maps.Equal(got, want) {
+		t.Errorf("reported ByCriticality %v, want %v", got, want)
+	}
+}
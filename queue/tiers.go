@@ -0,0 +1,134 @@
+package queue
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/asuffield/shedding"
+)
+
+// next returns the index in q.l of the element to dequeue next. Without
+// TierWeights this is the head. With them, tiers of elements with the same
+// criticality, after aging, take turns by deficit round robin, most critical
+// first: each
+// turn adds the tier's weight to its deficit, and the tier's earliest element
+// may be dequeued if its weight is covered by the deficit. If charge is false,
+// the choice is made without updating the round robin state, as for Peek. Must
+// be called with q.mux held and q.l non-empty.
+func (q *Queue[T]) next(charge bool) int {
+	if len(q.Config.TierWeights) == 0 {
+		return 0
+	}
+	rr := q.roundRobin(false)
+	i := rr.take()
+	if charge {
+		q.deficit, q.tier, q.tierActive = rr.deficit, rr.tier, true
+	}
+	return i
+}
+
+// dequeueOrder returns the indices of q.l in the order they would be dequeued
+// if nothing else were inserted, for projecting dequeue times when shedding.
+// Without TierWeights that is the order of q.l itself, and it returns nil.
+// Must be called with q.mux held.
+func (q *Queue[T]) dequeueOrder() []int {
+	if len(q.Config.TierWeights) == 0 || q.l.len() == 0 {
+		return nil
+	}
+	rr := q.roundRobin(true)
+	order := make([]int, 0, q.l.len())
+	for len(order) < q.l.len() {
+		order = append(order, rr.take())
+	}
+	return order
+}
+
+// rrState is a copy of the TierWeights round robin state, which take advances
+// as if the elements it returns were dequeued
+type rrState[T any] struct {
+	q       *Queue[T]
+	tiers   []shedding.Criticality         // most critical first, of those with elements left
+	members map[shedding.Criticality][]int // indices in q.l of each tier's elements, by aged criticality, earliest first
+	deficit map[shedding.Criticality]float64
+	tier    shedding.Criticality
+	active  bool
+}
+
+// roundRobin returns the current round robin state. Unless all is set, only
+// the earliest element of each tier is included, which is enough for one take.
+func (q *Queue[T]) roundRobin(all bool) *rrState[T] {
+	rr := &rrState[T]{
+		q:       q,
+		members: map[shedding.Criticality][]int{},
+		deficit: map[shedding.Criticality]float64{},
+		tier:    q.tier,
+		active:  q.tierActive,
+	}
+	now := q.Config.Clock.Now()
+	for i, e := range q.l.all() {
+		c := q.aged(e, now)
+		if m, ok := rr.members[c]; !ok || all {
+			rr.members[c] = append(m, i)
+		}
+	}
+	rr.tiers = slices.SortedFunc(maps.Keys(rr.members), func(a, b shedding.Criticality) int {
+		// Most critical first
+		switch {
+		case q.less(b, a):
+			return -1
+		case q.less(a, b):
+			return 1
+		}
+		return 0
+	})
+	maps.Copy(rr.deficit, q.deficit)
+	return rr
+}
+
+func (rr *rrState[T]) quantum(c shedding.Criticality) float64 {
+	if w := rr.q.Config.TierWeights[c]; w > 0 {
+		return float64(w)
+	}
+	return 1
+}
+
+// take returns the index of the next element to dequeue, and charges its tier
+// for it. There must be elements left.
+func (rr *rrState[T]) take() int {
+	for c := range rr.deficit {
+		// Tiers which have emptied forget their deficit
+		if len(rr.members[c]) == 0 {
+			delete(rr.deficit, c)
+		}
+	}
+	weight := func(pos int) float64 {
+		return rr.q.l.at(rr.members[rr.tiers[pos]][0]).weight
+	}
+
+	// Continue with the current tier if it still has elements, otherwise start
+	// the turn of the next one
+	pos := slices.Index(rr.tiers, rr.tier)
+	if !rr.active || pos < 0 {
+		pos = 0
+		if rr.active {
+			for pos < len(rr.tiers) && rr.q.less(rr.tier, rr.tiers[pos]) {
+				pos++
+			}
+			pos %= len(rr.tiers)
+		}
+		rr.deficit[rr.tiers[pos]] += rr.quantum(rr.tiers[pos])
+	}
+	for rr.deficit[rr.tiers[pos]] < weight(pos) {
+		pos = (pos + 1) % len(rr.tiers)
+		rr.deficit[rr.tiers[pos]] += rr.quantum(rr.tiers[pos])
+	}
+
+	c := rr.tiers[pos]
+	i := rr.members[c][0]
+	rr.deficit[c] -= rr.q.l.at(i).weight
+	rr.tier, rr.active = c, true
+	if rr.members[c] = rr.members[c][1:]; len(rr.members[c]) == 0 {
+		rr.tiers = slices.Delete(rr.tiers, pos, pos+1)
+	}
+	return i
+}
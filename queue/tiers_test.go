@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/benbjohnson/clock"
+)
+
+func TestTierWeightsRatio(t *testing.T) {
+	q := &Queue[shedding.Criticality]{}
+	q.Config.TierWeights = map[shedding.Criticality]int{shedding.Critical: 3, shedding.Sheddable: 1}
+	for i := 0; i < 400; i++ {
+		q.Insert(context.Background(), shedding.Critical, shedding.Critical, nil)
+		q.Insert(context.Background(), shedding.Sheddable, shedding.Sheddable, nil)
+	}
+
+	served := map[shedding.Criticality]int{}
+	for i := 0; i < 400; i++ {
+		v, _ := q.Remove()
+		served[v]++
+	}
+	if served[shedding.Critical] != 300 || served[shedding.Sheddable] != 100 {
+		t.Errorf("served %v, want 300 critical to 100 sheddable", served)
+	}
+}
+
+func TestTierWeightsProjection(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	q.Config.TierWeights = map[shedding.Criticality]int{shedding.Critical: 1}
+	for i := 0; i < 3; i++ {
+		q.Insert(context.Background(), shedding.Critical, "critical", nil)
+	}
+	// Fourth in the queue, but second to be dequeued, which is in time
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(2500*time.Millisecond))
+	defer cancel()
+	if !q.TryInsert(ctx, shedding.Sheddable, "sheddable", nil) {
+		t.Fatal("element due in time by its tier's turn was shed")
+	}
+
+	q.Remove()
+	if v, _ := q.Remove(); v != "sheddable" {
+		t.Errorf("second Remove() = %q, want sheddable", v)
+	}
+}
+
+func TestTierWeightsAging(t *testing.T) {
+	for _, aged := range []bool{false, true} {
+		mc := clock.NewMock()
+		mc.Set(time.Now())
+		q := &Queue[string]{}
+		q.Config.Clock = mc
+		q.Config.TierWeights = map[shedding.Criticality]int{shedding.Critical: 1, shedding.Sheddable: 1}
+		q.Config.AgingAfter = time.Minute
+		q.Insert(context.Background(), shedding.Sheddable, "old", nil)
+		if aged {
+			// Two levels, from Sheddable up to Critical
+			mc.Add(2 * time.Minute)
+		}
+
+		// Once aged, the old element takes its turn with the critical tier,
+		// ahead of the new one, which arrived later
+		q.Insert(context.Background(), shedding.Critical, "new", nil)
+		want := "new"
+		if aged {
+			want = "old"
+		}
+		if got, _ := q.Remove(); got != want {
+			t.Errorf("aged=%v: Remove() = %q, want %s", aged, got, want)
+		}
+	}
+}
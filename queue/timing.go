@@ -0,0 +1,364 @@
+package queue
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/asuffield/shedding"
+)
+
+// Estimator selects how the expected wait per item is computed from the
+// recent dequeue intervals. The percentile estimators sort a copy of the timing
+// history, costing O(n log n) in TimingHistory each time the estimate is
+// recomputed, which is at most once per dequeue.
+type Estimator int
+
+const (
+	// EstimatorMean uses the arithmetic mean. This is the cheapest estimator,
+	// needing only a single pass over the history unless DiscardOutliers is set.
+	EstimatorMean Estimator = iota
+	// EstimatorP50 uses the median interval.
+	EstimatorP50
+	// EstimatorP95 uses the 95th percentile interval, which is more resilient
+	// to bursty workloads where the mean underestimates tail latency.
+	EstimatorP95
+)
+
+// ExpectedWait returns the current estimate of the wait per item in the queue,
+// using the configured estimator. It returns zero until MinSamples samples have
+// been collected. This is a queue-wide figure; for how long an element of a
+// particular criticality would wait, given what is queued ahead of it, see
+// ExpectedWaitFor.
+func (q *Queue[T]) ExpectedWait() time.Duration {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.Config.defaults()
+	q.updateTiming()
+	return q.expectedWait
+}
+
+// IsWarmingUp reports whether fewer than MinSamples dequeues have been timed,
+// so that ExpectedWait is zero because there is no estimate yet, rather than
+// because dequeues are quick. Nothing is shed for its deadline until it
+// returns false.
+func (q *Queue[T]) IsWarmingUp() bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.Config.defaults()
+	return q.warmingUp()
+}
+
+// warmingUp implements IsWarmingUp. Must be called with q.mux held.
+func (q *Queue[T]) warmingUp() bool {
+	if q.Config.UseEWMA {
+		return q.ewmaSamples < q.Config.MinSamples
+	}
+	return q.recentDequeue.len() < q.Config.MinSamples
+}
+
+// ServiceTime returns the estimated time each consumer spends on an element,
+// which is ExpectedWait multiplied by Consumers. ExpectedWait is the interval
+// between dequeues across all consumers, so with N consumers it is about 1/N
+// of the service time; that is the right figure for projecting how long an
+// element will wait, since each position ahead of it clears that quickly, so
+// deadline shedding uses ExpectedWait unchanged. It returns zero until the
+// estimate is ready.
+func (q *Queue[T]) ServiceTime() time.Duration {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.Config.defaults()
+	q.updateTiming()
+	return q.expectedWait * time.Duration(q.Config.Consumers)
+}
+
+// Throughput returns the dequeue rate implied by ExpectedWait, in elements
+// per second, or per unit of weight with InsertWeighted. It returns zero until
+// the estimate is ready.
+func (q *Queue[T]) Throughput() float64 {
+	return throughput(q.ExpectedWait())
+}
+
+func throughput(wait time.Duration) float64 {
+	if wait <= 0 {
+		return 0
+	}
+	return float64(time.Second) / float64(wait)
+}
+
+// ProjectedWait returns how long a new element of criticality crit would be
+// expected to wait if it were inserted now. Less critical elements ahead of it
+// are not counted, since they would be shed if they stopped it meeting its
+// deadline. Like ExpectedWait, it returns zero until the estimate is ready.
+func (q *Queue[T]) ProjectedWait(crit shedding.Criticality) time.Duration {
+	q.mux.Lock()
+	defer q.unlock()
+	q.shedLocked()
+
+	return q.projectedWait(crit, 1, q.Config.Clock.Now())
+}
+
+// ExpectedWaitFor returns how long a new element of criticality crit would be
+// expected to wait if it were inserted now, for admission decisions per tier.
+// It is the same projection as ProjectedWait, and shedding, use.
+func (q *Queue[T]) ExpectedWaitFor(crit shedding.Criticality) time.Duration {
+	q.mux.Lock()
+	defer q.unlock()
+	q.shedLocked()
+	return q.projectedWait(crit, 1, q.Config.Clock.Now())
+}
+
+// projectedWait implements ProjectedWait, for an element of the given weight.
+// Must be called with q.mux held, after updateTiming.
+func (q *Queue[T]) projectedWait(crit shedding.Criticality, weight float64, now time.Time) time.Duration {
+	if q.expectedWait == 0 {
+		return 0
+	}
+	ahead := 0.0
+	for _, e := range q.l.all() {
+		if !q.less(q.priority(e, now), crit) {
+			ahead += e.weight
+		}
+	}
+	return time.Duration((ahead+weight)*float64(q.itemWait())) + q.overrun(now)
+}
+
+// overrun returns how much later than the wait estimate the next dequeue is
+// expected, with InFlightBias: how long the consumers have gone beyond the
+// expected wait without a dequeue, or zero. That is counted from the last
+// dequeue, or from when the queue last became non-empty if that was later,
+// since the consumers can't have been overrunning while there was nothing for
+// them to dequeue. Must be called with q.mux held, after updateTiming.
+func (q *Queue[T]) overrun(now time.Time) time.Duration {
+	if !q.Config.InFlightBias || q.expectedWait == 0 || q.lastDequeue.IsZero() || q.l.len() == 0 {
+		return 0
+	}
+	since := q.lastDequeue
+	if q.filledAt.After(since) {
+		since = q.filledAt
+	}
+	return max(now.Sub(since)-q.itemWait(), 0)
+}
+
+// ResetTiming discards the timing history, e.g. after the consumers have been
+// scaled. Until enough new samples have been collected, no elements are shed
+// for being expected to miss their deadline.
+func (q *Queue[T]) ResetTiming() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.recentDequeue.reset()
+	q.ewma = 0
+	q.ewmaSamples = 0
+	q.expectedWait = 0
+	q.timingStale = true
+}
+
+// ExportTiming returns the timing history, oldest first, so that it can be
+// restored into a new process with ImportTiming, which then starts with an
+// estimate rather than warming up. With UseEWMA, there is no history, so it
+// returns the current average once for each sample it covers, up to
+// TimingHistory.
+func (q *Queue[T]) ExportTiming() []time.Duration {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.Config.defaults()
+
+	if q.Config.UseEWMA {
+		intervals := make([]time.Duration, min(q.ewmaSamples, q.Config.TimingHistory))
+		for i := range intervals {
+			intervals[i] = time.Duration(q.ewma)
+		}
+		return intervals
+	}
+	a, b := q.recentDequeue.segments()
+	return append(slices.Clone(a), b...)
+}
+
+// ImportTiming replaces the timing history with intervals, oldest first, as
+// returned by ExportTiming. If there are more than TimingHistory, only the most
+// recent are kept. Intervals are filtered as if they had just been measured, so
+// negative ones are taken as zero and those over MaxInterval are discarded.
+func (q *Queue[T]) ImportTiming(intervals []time.Duration) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.Config.defaults()
+
+	q.recentDequeue.reset()
+	q.ewma = 0
+	q.ewmaSamples = 0
+	for _, interval := range intervals[max(len(intervals)-q.Config.TimingHistory, 0):] {
+		interval = max(interval, 0)
+		if q.Config.MaxInterval > 0 && interval > q.Config.MaxInterval {
+			continue
+		}
+		q.addSample(interval)
+	}
+}
+
+// itemWait returns the time to allow for each element when projecting dequeue
+// times, which is the expected wait adjusted by the safety settings. Must be
+// called with q.mux held, after updateTiming.
+func (q *Queue[T]) itemWait() time.Duration {
+	return time.Duration(float64(q.expectedWait)*q.Config.SafetyFactor) + q.Config.SafetyMargin
+}
+
+// recordDequeue records the dequeue of n elements with a total weight of
+// weight. The interval since the previous dequeue is divided by the weight, so
+// the estimate is per unit weight. If the clock went backwards the interval is
+// taken as zero, and intervals over MaxInterval are not recorded. The first
+// dequeue has no previous one to measure from, so it only starts the clock.
+// Must be called with q.mux held.
+func (q *Queue[T]) recordDequeue(n int, weight float64) {
+	now := q.Config.Clock.Now()
+	if q.lastDequeue.IsZero() {
+		q.lastDequeue = now
+		return
+	}
+	interval := time.Duration(math.MaxInt64)
+	if f := float64(max(now.Sub(q.lastDequeue), 0)) / weight; f < math.MaxInt64 {
+		interval = time.Duration(f)
+	}
+	q.lastDequeue = now
+	if q.Config.MaxInterval > 0 && interval > q.Config.MaxInterval {
+		return
+	}
+	for i := 0; i < n; i++ {
+		q.addSample(interval)
+	}
+}
+
+// addSample adds a single dequeue interval to the timing history
+func (q *Queue[T]) addSample(interval time.Duration) {
+	if q.Config.UseEWMA {
+		if q.ewmaSamples == 0 {
+			q.ewma = float64(interval)
+		} else {
+			q.ewma += q.Config.EWMAAlpha * (float64(interval) - q.ewma)
+		}
+		q.ewmaSamples++
+		return
+	}
+	// Allocated on first use, so the buffer is never copied once full
+	q.recentDequeue.reserve(q.Config.TimingHistory)
+	for q.recentDequeue.len() >= q.Config.TimingHistory {
+		q.recentDequeue.popFront()
+	}
+	q.recentDequeue.pushBack(interval)
+	q.timingStale = true
+}
+
+// updateTiming must be called with q.mux held
+func (q *Queue[T]) updateTiming() {
+	if q.warmingUp() {
+		// Not enough data to estimate yet - this prevents shedding based on deadlines
+		q.expectedWait = 0
+		return
+	}
+	if q.Config.UseEWMA {
+		q.expectedWait = max(time.Duration(q.ewma), q.Config.MinExpectedWait)
+		return
+	}
+	if !q.timingStale {
+		// No new data, no need to recompute
+		return
+	}
+	q.timingStale = false
+	q.expectedWait = max(q.estimate(), q.Config.MinExpectedWait)
+}
+
+// estimate computes the wait per item from the timing history, which must not
+// be empty
+func (q *Queue[T]) estimate() time.Duration {
+	n := q.recentDequeue.len()
+	a, b := q.recentDequeue.segments()
+	discard := q.Config.DiscardOutliers
+	if q.Config.AutoOutliers {
+		discard = autoOutliers(a, b)
+	}
+	trim := q.Config.OutlierMAD == 0 && discard > 0 && 2*discard < n
+	if !trim && q.Config.OutlierMAD == 0 && q.Config.Estimator == EstimatorMean && q.Config.Aggregate == nil {
+		// The mean needs no sorting, so read the history in place
+		return (sum(a) + sum(b)) / time.Duration(n)
+	}
+
+	intervals := make([]time.Duration, 0, n)
+	intervals = append(append(intervals, a...), b...)
+	// Stability doesn't matter: equal intervals are indistinguishable, so the
+	// trimmed values, and the estimate, depend only on the history
+	slices.Sort(intervals)
+	if trim {
+		intervals = intervals[discard : len(intervals)-discard]
+	}
+	if q.Config.OutlierMAD > 0 {
+		intervals = withinMAD(intervals, q.Config.OutlierMAD)
+	}
+
+	switch {
+	case q.Config.Aggregate != nil:
+		return q.Config.Aggregate(intervals)
+	case q.Config.Estimator == EstimatorP50:
+		return percentile(intervals, 0.5)
+	case q.Config.Estimator == EstimatorP95:
+		return percentile(intervals, 0.95)
+	default:
+		return sum(intervals) / time.Duration(len(intervals))
+	}
+}
+
+// autoOutliers returns how many intervals AutoOutliers discards from each end
+// of the history, given as two segments. That is the amount by which the
+// coefficient of variation (the standard deviation over the mean) exceeds 0.1,
+// times a tenth of the history, rounded down and capped at a tenth of the
+// history. So with 100 intervals, a CV under 0.2 keeps every interval and one
+// over 1.1 discards the top and bottom 10%. A short history has to be
+// noisier to lose any.
+func autoOutliers(a, b []time.Duration) int {
+	n := float64(len(a) + len(b))
+	mean := float64(sum(a)+sum(b)) / n
+	if mean <= 0 {
+		return 0
+	}
+	variance := 0.0
+	for _, s := range [][]time.Duration{a, b} {
+		for _, t := range s {
+			variance += (float64(t) - mean) * (float64(t) - mean)
+		}
+	}
+	cv := math.Sqrt(variance/n) / mean
+	return int(n * min(max(cv-0.1, 0), 1) / 10)
+}
+
+func sum(intervals []time.Duration) time.Duration {
+	var total time.Duration
+	for _, t := range intervals {
+		total += t
+	}
+	return total
+}
+
+// withinMAD returns the elements of sorted which are no more than k median
+// absolute deviations from the median. Since sorted is sorted, they are a
+// contiguous range of it, which always includes the median.
+func withinMAD(sorted []time.Duration, k float64) []time.Duration {
+	median := percentile(sorted, 0.5)
+	deviations := make([]time.Duration, len(sorted))
+	for i, t := range sorted {
+		deviations[i] = max(t-median, median-t)
+	}
+	slices.Sort(deviations)
+	limit := time.Duration(k * float64(percentile(deviations, 0.5)))
+
+	lo := sort.Search(len(sorted), func(i int) bool { return sorted[i] >= median-limit })
+	hi := sort.Search(len(sorted), func(i int) bool { return sorted[i] > median+limit })
+	return sorted[lo:hi]
+}
+
+// percentile returns the p'th percentile of sorted, by the nearest-rank method
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
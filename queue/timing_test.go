@@ -0,0 +1,1067 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/benbjohnson/clock"
+)
+
+// newTimedQueue returns a queue on a mock clock whose wait estimate is ready,
+// at interval per element
+func newTimedQueue(t testing.TB, interval time.Duration) (*Queue[string], *clock.Mock) {
+	t.Helper()
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	q.Config.TimingHistory = 4
+	for i := 0; i <= q.Config.TimingHistory; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, "prime", nil)
+		mc.Add(interval)
+		if _, ok := q.Remove(); !ok {
+			t.Fatal("priming element was shed")
+		}
+	}
+	if w := q.ExpectedWait(); w != interval {
+		t.Fatalf("ExpectedWait() = %v after priming, want %v", w, interval)
+	}
+	return q, mc
+}
+
+func TestPeek(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	before := q.ExportTiming()
+	cancelled, cancel := context.WithCancel(context.Background())
+	q.Insert(cancelled, shedding.Sheddable, "cancelled", cancel)
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+	cancel()
+
+	for i := 0; i < 3; i++ {
+		mc.Add(time.Minute)
+		if v, ok := q.Peek(); !ok || v != "a" {
+			t.Fatalf("Peek() = %q, %v, want a", v, ok)
+		}
+	}
+	if n := q.Len(); n != 2 {
+		t.Errorf("Len() = %d after Peek, want 2", n)
+	}
+	if got := q.ExportTiming(); !slices.Equal(got, before) {
+		t.Errorf("timing history after Peek = %v, want it unchanged at %v", got, before)
+	}
+	if v, _ := q.Remove(); v != "a" {
+		t.Errorf("Remove() after Peek = %q, want a", v)
+	}
+}
+
+func TestOnShed(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	reasons := map[string]ShedReason{}
+	q.Config.OnShed = func(_ shedding.Criticality, v string, reason ShedReason) {
+		reasons[v] = reason
+		// Called without the lock held, so this mustn't deadlock
+		q.Len()
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.Insert(cancelled, shedding.Sheddable, "cancelled", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "ahead", nil)
+	late, cancel := context.WithDeadline(context.Background(), mc.Now().Add(1500*time.Millisecond))
+	defer cancel()
+	q.Insert(late, shedding.Sheddable, "late", nil)
+
+	want := map[string]ShedReason{"cancelled": ShedCancelled, "late": ShedDeadline}
+	if !maps.Equal(reasons, want) {
+		t.Errorf("OnShed got %v, want %v", reasons, want)
+	}
+}
+
+func TestDiscardOutliers(t *testing.T) {
+	samples := []time.Duration{time.Second, time.Second, 100 * time.Second, time.Second, time.Second}
+	for _, tc := range []struct {
+		discard int
+		want    time.Duration
+	}{
+		{0, 20800 * time.Millisecond},
+		{1, time.Second},
+	} {
+		q := &Queue[string]{}
+		q.Config.TimingHistory = len(samples)
+		q.Config.DiscardOutliers = tc.discard
+		q.ImportTiming(samples)
+		if got := q.ExpectedWait(); got != tc.want {
+			t.Errorf("DiscardOutliers=%d: ExpectedWait() = %v, want %v", tc.discard, got, tc.want)
+		}
+	}
+}
+
+func TestDiscardOutliersClamped(t *testing.T) {
+	// Half the history or more would leave nothing to estimate from
+	for _, discard := range []int{2, 3, 10} {
+		q := &Queue[string]{}
+		q.Config.TimingHistory = 4
+		q.Config.DiscardOutliers = discard
+		q.ImportTiming([]time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second})
+		if got := q.ExpectedWait(); got < 2*time.Second || got > 3*time.Second {
+			t.Errorf("DiscardOutliers=%d of 4: ExpectedWait() = %v, want the middle of the history", discard, got)
+		}
+		if q.Config.DiscardOutliers != 1 {
+			t.Errorf("DiscardOutliers=%d of 4 clamped to %d, want 1", discard, q.Config.DiscardOutliers)
+		}
+	}
+}
+
+func TestShedToSave(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	var shed []string
+	q.Config.OnShed = func(_ shedding.Criticality, v string, _ ShedReason) {
+		shed = append(shed, v)
+	}
+	later, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Hour))
+	defer cancel()
+	q.Insert(later, shedding.Sheddable, "first", nil)
+	q.Insert(later, shedding.Sheddable, "second", nil)
+	soon, cancel := context.WithDeadline(context.Background(), mc.Now().Add(2500*time.Millisecond))
+	defer cancel()
+	q.Insert(soon, shedding.Critical, "critical", nil)
+
+	if got := removeAll(q); !slices.Equal(got, []string{"first", "critical"}) {
+		t.Errorf("dequeued %q, want [first critical]", got)
+	}
+	if !slices.Equal(shed, []string{"second"}) {
+		t.Errorf("shed %q, want [second]", shed)
+	}
+}
+
+func TestEstimator(t *testing.T) {
+	// 1ms to 100ms, shuffled
+	samples := make([]time.Duration, 100)
+	for i := range samples {
+		samples[i] = time.Duration((i*37)%100+1) * time.Millisecond
+	}
+	for _, tc := range []struct {
+		estimator Estimator
+		min, max  time.Duration
+	}{
+		{EstimatorMean, 50 * time.Millisecond, 51 * time.Millisecond},
+		{EstimatorP50, 50 * time.Millisecond, 51 * time.Millisecond},
+		{EstimatorP95, 95 * time.Millisecond, 96 * time.Millisecond},
+	} {
+		q := &Queue[string]{}
+		q.Config.TimingHistory = len(samples)
+		q.Config.Estimator = tc.estimator
+		q.ImportTiming(samples)
+		if got := q.ExpectedWait(); got < tc.min || got > tc.max {
+			t.Errorf("Estimator %d: ExpectedWait() = %v, want between %v and %v", tc.estimator, got, tc.min, tc.max)
+		}
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	before := slices.Repeat([]time.Duration{10 * time.Millisecond}, 20)
+	after := slices.Repeat([]time.Duration{100 * time.Millisecond}, 5)
+
+	window := &Queue[string]{}
+	window.Config.TimingHistory = 20
+	window.ImportTiming(append(before, after...))
+
+	ewma := &Queue[string]{}
+	ewma.Config.TimingHistory = 20
+	ewma.Config.UseEWMA = true
+	ewma.Config.EWMAAlpha = 0.5
+	ewma.Config.MinSamples = 3
+	ewma.ImportTiming(before[:2])
+	if got := ewma.ExpectedWait(); got != 0 {
+		t.Errorf("ExpectedWait() = %v before MinSamples, want 0", got)
+	}
+	ewma.ImportTiming(append(before, after...))
+
+	// Five samples after the step, the average has moved most of the way, while
+	// the window is still dominated by the old rate
+	w, e := window.ExpectedWait(), ewma.ExpectedWait()
+	if e < 90*time.Millisecond || w > 40*time.Millisecond {
+		t.Errorf("after a step from 10ms to 100ms, EWMA = %v and window mean = %v", e, w)
+	}
+}
+
+func TestExpectedWaitWarmup(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	q.Config.TimingHistory = 4
+	for i := 0; i <= q.Config.TimingHistory; i++ {
+		if w, warm := q.ExpectedWait(), q.IsWarmingUp(); w != 0 || !warm {
+			t.Fatalf("after %d dequeues: ExpectedWait() = %v, IsWarmingUp() = %v, want zero while warming up", i, w, warm)
+		}
+		q.Insert(context.Background(), shedding.Sheddable, "sample", nil)
+		mc.Add(time.Second)
+		q.Remove()
+	}
+	if w, warm := q.ExpectedWait(), q.IsWarmingUp(); w != time.Second || warm {
+		t.Errorf("once warmed up: ExpectedWait() = %v, IsWarmingUp() = %v, want 1s", w, warm)
+	}
+}
+
+func TestResetTiming(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(500*time.Millisecond))
+	defer cancel()
+	q.Insert(ctx, shedding.Sheddable, "late", nil)
+	if n := q.Len(); n != 0 {
+		t.Fatal("element due before the first dequeue was not shed")
+	}
+
+	q.ResetTiming()
+	if w, warm := q.ExpectedWait(), q.IsWarmingUp(); w != 0 || !warm {
+		t.Errorf("after ResetTiming: ExpectedWait() = %v, IsWarmingUp() = %v, want zero while warming up", w, warm)
+	}
+	q.Insert(ctx, shedding.Sheddable, "late", nil)
+	if n := q.Len(); n != 1 {
+		t.Error("element was shed for its deadline straight after ResetTiming")
+	}
+}
+
+func TestMinSamples(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	q.Config.TimingHistory = 100
+	q.Config.MinSamples = 3
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(500*time.Millisecond))
+	defer cancel()
+
+	q.ImportTiming(slices.Repeat([]time.Duration{time.Second}, 2))
+	q.Insert(ctx, shedding.Sheddable, "late", nil)
+	if w, warm, n := q.ExpectedWait(), q.IsWarmingUp(), q.Len(); w != 0 || !warm || n != 1 {
+		t.Errorf("with 2 samples: ExpectedWait() = %v, IsWarmingUp() = %v, Len() = %d, want no estimate and nothing shed", w, warm, n)
+	}
+
+	// Well short of TimingHistory, but enough to start shedding
+	q.ImportTiming(slices.Repeat([]time.Duration{time.Second}, 3))
+	q.Insert(ctx, shedding.Sheddable, "late", nil)
+	if w, warm, n := q.ExpectedWait(), q.IsWarmingUp(), q.Len(); w != time.Second || warm || n != 0 {
+		t.Errorf("with 3 samples: ExpectedWait() = %v, IsWarmingUp() = %v, Len() = %d, want 1s and both late elements shed", w, warm, n)
+	}
+}
+
+func TestSafetyFactor(t *testing.T) {
+	for _, tc := range []struct {
+		factor float64
+		margin time.Duration
+		kept   int
+	}{
+		{1, 0, 4},
+		{2, 0, 2},
+		{1, 500 * time.Millisecond, 2},
+		{2, 500 * time.Millisecond, 1},
+	} {
+		q, mc := newTimedQueue(t, time.Second)
+		q.Config.SafetyFactor = tc.factor
+		q.Config.SafetyMargin = tc.margin
+		ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(4200*time.Millisecond))
+		for i := 0; i < 4; i++ {
+			q.Insert(ctx, shedding.Sheddable, "a", nil)
+		}
+		if n := q.Len(); n != tc.kept {
+			t.Errorf("SafetyFactor %v, SafetyMargin %v: kept %d of 4, want %d", tc.factor, tc.margin, n, tc.kept)
+		}
+		cancel()
+	}
+}
+
+func TestInsertWeighted(t *testing.T) {
+	for _, tc := range []struct {
+		heavy float64
+		kept  int
+	}{
+		{2, 2},
+		{3, 1},
+	} {
+		q, mc := newTimedQueue(t, time.Second)
+		q.InsertWeighted(context.Background(), shedding.Sheddable, "heavy", tc.heavy, nil)
+		ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(3500*time.Millisecond))
+		q.InsertWeighted(ctx, shedding.Sheddable, "light", 1, nil)
+		if n := q.Len(); n != tc.kept {
+			t.Errorf("behind an element of weight %v: Len() = %d, want %d", tc.heavy, n, tc.kept)
+		}
+		cancel()
+	}
+}
+
+func TestWeightedTiming(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	q.Config.TimingHistory = 4
+	for i := 0; i <= q.Config.TimingHistory; i++ {
+		q.InsertWeighted(context.Background(), shedding.Sheddable, "a", 4, nil)
+		mc.Add(2 * time.Second)
+		q.Remove()
+	}
+	if w := q.ExpectedWait(); w != 500*time.Millisecond {
+		t.Errorf("ExpectedWait() = %v dequeuing weight 4 every 2s, want 500ms per unit", w)
+	}
+}
+
+func TestShedInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, time.Second} {
+		q, mc := newTimedQueue(t, time.Second)
+		q.Config.ShedInterval = interval
+		shed := make(chan string, 1)
+		q.Config.OnShed = func(_ shedding.Criticality, v string, _ ShedReason) { shed <- v }
+		ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(3*time.Second))
+		q.Insert(ctx, shedding.Sheddable, "idle", nil)
+
+		// Nothing touches the queue while it passes the point of no return
+		mc.Add(4 * time.Second)
+		select {
+		case <-shed:
+			if interval == 0 {
+				t.Error("element shed with no ShedInterval and nothing calling the queue")
+			}
+		case <-time.After(100 * time.Millisecond):
+			if interval > 0 {
+				t.Error("element wasn't shed in the background")
+			}
+		}
+		q.Close()
+		cancel()
+	}
+}
+
+func TestProjectedWait(t *testing.T) {
+	q, _ := newTimedQueue(t, time.Second)
+	for _, tc := range []struct {
+		insert shedding.Criticality // inserted before projecting
+		want   map[shedding.Criticality]time.Duration
+	}{
+		{-1, map[shedding.Criticality]time.Duration{shedding.Sheddable: time.Second, shedding.CriticalPlus: time.Second}},
+		{shedding.Critical, map[shedding.Criticality]time.Duration{shedding.Sheddable: 2 * time.Second, shedding.Critical: 2 * time.Second, shedding.CriticalPlus: time.Second}},
+		{shedding.Sheddable, map[shedding.Criticality]time.Duration{shedding.Sheddable: 3 * time.Second, shedding.Critical: 2 * time.Second, shedding.CriticalPlus: time.Second}},
+		{shedding.CriticalPlus, map[shedding.Criticality]time.Duration{shedding.Sheddable: 4 * time.Second, shedding.Critical: 3 * time.Second, shedding.CriticalPlus: 2 * time.Second}},
+	} {
+		if tc.insert >= 0 {
+			q.Insert(context.Background(), tc.insert, "a", nil)
+		}
+		for crit, want := range tc.want {
+			if got := q.ProjectedWait(crit); got != want {
+				t.Errorf("at depth %d: ProjectedWait(%v) = %v, want %v", q.Len(), crit, got, want)
+			}
+		}
+	}
+}
+
+func TestInsertDeadline(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		ctx, explicit time.Duration
+		kept          bool
+	}{
+		{"explicit earlier", 10 * time.Second, 500 * time.Millisecond, false},
+		{"explicit later", 500 * time.Millisecond, 10 * time.Second, false},
+		{"both in time", 10 * time.Second, 5 * time.Second, true},
+	} {
+		q, mc := newTimedQueue(t, time.Second)
+		ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(tc.ctx))
+		q.InsertDeadline(ctx, shedding.Sheddable, "a", mc.Now().Add(tc.explicit), nil)
+		if kept := q.Len() == 1; kept != tc.kept {
+			t.Errorf("%s: kept = %v, want %v", tc.name, kept, tc.kept)
+		}
+		cancel()
+		if _, ok := q.Peek(); ok {
+			t.Errorf("%s: element kept after its context was cancelled", tc.name)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	q := &Queue[string]{}
+	q.Config.TimingHistory = 5
+	q.Config.DiscardOutliers = 1
+	var passed []time.Duration
+	q.Config.Aggregate = func(intervals []time.Duration) time.Duration {
+		passed = slices.Clone(intervals)
+		return slices.Max(intervals)
+	}
+	q.ImportTiming([]time.Duration{5 * time.Millisecond, time.Hour, 20 * time.Millisecond, 0, 10 * time.Millisecond})
+
+	// The largest once the outliers are trimmed
+	if got := q.ExpectedWait(); got != 20*time.Millisecond {
+		t.Errorf("ExpectedWait() = %v, want the max, 20ms", got)
+	}
+	if want := []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond}; !slices.Equal(passed, want) {
+		t.Errorf("Aggregate was passed %v, want %v", passed, want)
+	}
+}
+
+// BenchmarkTimingHistory compares recording a dequeue interval into a full
+// history, as the ring does, with the slice it replaced, which appended and
+// then copied the history down to trim it
+func BenchmarkTimingHistory(b *testing.B) {
+	const history = 1000
+	b.Run("ring", func(b *testing.B) {
+		var r ring[time.Duration]
+		r.reserve(history)
+		for i := 0; i < b.N; i++ {
+			for r.len() >= history {
+				r.popFront()
+			}
+			r.pushBack(time.Duration(i))
+		}
+	})
+
+	b.Run("slice", func(b *testing.B) {
+		var s []time.Duration
+		for i := 0; i < b.N; i++ {
+			s = append(s, time.Duration(i))
+			if len(s) > history {
+				copy(s, s[1:])
+				s = s[:history]
+			}
+		}
+	})
+}
+
+// BenchmarkRemove measures the dequeue hot path with a full timing history.
+// The mock clock isn't advanced, since that sleeps; every interval is zero.
+func BenchmarkRemove(b *testing.B) {
+	q, _ := newTimedQueue(b, time.Millisecond)
+	q.Config.TimingHistory = 1000
+	q.ImportTiming(make([]time.Duration, 1000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+		q.Remove()
+	}
+}
+
+func TestClockJumps(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	q.Config.TimingHistory = 4
+	q.Config.MaxInterval = time.Minute
+	remove := func(after time.Duration) {
+		q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+		mc.Add(after)
+		q.Remove()
+	}
+	remove(time.Second)
+	// Backwards, then far forwards
+	mc.Set(mc.Now().Add(-time.Hour))
+	remove(time.Second)
+	remove(24 * time.Hour)
+	for i := 0; i < 3; i++ {
+		remove(time.Second)
+	}
+	if got, want := q.ExportTiming(), []time.Duration{0, time.Second, time.Second, time.Second}; !slices.Equal(got, want) {
+		t.Errorf("timing history %v, want %v: the backward jump as zero, without the day", got, want)
+	}
+	if w := q.ExpectedWait(); w < 0 || w > time.Second {
+		t.Errorf("ExpectedWait() = %v after clock jumps, want between 0 and 1s", w)
+	}
+}
+
+func TestFirstDequeueInterval(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	mc.Add(time.Second)
+	q.Remove()
+	// With nothing to measure it from, the first dequeue only starts the clock
+	if got := q.ExportTiming(); len(got) != 0 {
+		t.Errorf("timing history %v after the first dequeue, want it empty", got)
+	}
+}
+
+func TestOverloadCallbacks(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	q.Config.OverloadCooldown = 10 * time.Second
+	var events []string
+	q.Config.OnOverloadStart = func() { events = append(events, "start") }
+	q.Config.OnOverloadEnd = func() { events = append(events, "end") }
+	insertLate := func() {
+		ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Millisecond))
+		defer cancel()
+		q.Insert(ctx, shedding.Sheddable, "late", nil)
+	}
+	step := func(when string, want ...string) {
+		t.Helper()
+		if !slices.Equal(events, want) {
+			t.Errorf("%s: callbacks %q, want %q", when, events, want)
+		}
+		events = nil
+	}
+
+	insertLate()
+	step("first deadline shed", "start")
+	insertLate()
+	step("still overloaded")
+	mc.Add(5 * time.Second)
+	q.Peek()
+	step("within the cooldown")
+	mc.Add(6 * time.Second)
+	q.Peek()
+	step("after the cooldown", "end")
+	q.Peek()
+	step("recovered")
+	insertLate()
+	step("overloaded again", "start")
+}
+
+func TestShed(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(4500*time.Millisecond))
+	defer cancel()
+	for _, v := range []string{"a", "b", "c", "d"} {
+		q.Insert(ctx, shedding.Sheddable, v, nil)
+	}
+	mc.Add(2 * time.Second)
+	if got := q.Shed(); !slices.Equal(got, []string{"c", "d"}) {
+		t.Errorf("Shed() = %q, want [c d]", got)
+	}
+	if got := q.Shed(); len(got) != 0 {
+		t.Errorf("second Shed() = %q, want nothing", got)
+	}
+}
+
+func TestOutlierMAD(t *testing.T) {
+	// 9ms to 11ms, with a varying number of extreme outliers mixed in
+	base := []time.Duration{9 * time.Millisecond, 10 * time.Millisecond, 11 * time.Millisecond}
+	for _, outliers := range []int{0, 1, 5, 20} {
+		var samples []time.Duration
+		for i := 0; i < 40; i++ {
+			samples = append(samples, base[i%3])
+			if i < outliers {
+				samples = append(samples, 10*time.Second)
+			}
+		}
+		q := &Queue[string]{}
+		q.Config.TimingHistory = len(samples)
+		q.Config.OutlierMAD = 3
+		q.ImportTiming(samples)
+		if got := q.ExpectedWait(); got < 9*time.Millisecond || got > 11*time.Millisecond {
+			t.Errorf("with %d outliers: ExpectedWait() = %v, want about 10ms", outliers, got)
+		}
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	q := &Queue[string]{}
+	if got := q.Throughput(); got != 0 {
+		t.Errorf("Throughput() = %v while warming up, want 0", got)
+	}
+	q, _ = newTimedQueue(t, 10*time.Millisecond)
+	if got := q.Throughput(); got < 99 || got > 101 {
+		t.Errorf("Throughput() = %v dequeuing every 10ms, want about 100", got)
+	}
+	if got := q.Stats().Throughput; got < 99 || got > 101 {
+		t.Errorf("Stats().Throughput = %v, want about 100", got)
+	}
+}
+
+func TestServiceTime(t *testing.T) {
+	mc := clock.NewMock()
+	mc.Set(time.Now())
+	q := &Queue[string]{}
+	q.Config.Clock = mc
+	q.Config.TimingHistory = 8
+	q.Config.Consumers = 4
+	// Four consumers, each taking 40ms per element and starting 10ms apart, so
+	// that the queue sees a dequeue every 10ms
+	for i := 0; i < 5; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	}
+	for i := 0; i < 20; i++ {
+		q.Remove()
+		q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+		mc.Add(10 * time.Millisecond)
+	}
+	if w, s := q.ExpectedWait(), q.ServiceTime(); w != 10*time.Millisecond || s != 40*time.Millisecond {
+		t.Errorf("ExpectedWait() = %v, ServiceTime() = %v, want 10ms between dequeues and 40ms per consumer", w, s)
+	}
+}
+
+func TestRejectLate(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	q.Config.RejectLate = true
+	var reasons []ShedReason
+	q.Config.OnShed = func(_ shedding.Criticality, _ string, reason ShedReason) {
+		reasons = append(reasons, reason)
+	}
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(1500*time.Millisecond))
+	defer cancel()
+	if q.Insert(ctx, shedding.Sheddable, "late", nil) {
+		t.Error("Insert of an element behind 3s of work with 1.5s to go = true, want false")
+	}
+	if !slices.Equal(reasons, []ShedReason{ShedDeadline}) {
+		t.Errorf("shed with reasons %v, want one for deadline", reasons)
+	}
+	// The sheddable elements ahead don't count against a critical one, which
+	// is admitted, and then they are shed to make way for it
+	if !q.Insert(ctx, shedding.Critical, "critical", nil) {
+		t.Error("Insert of a critical element which can be dequeued in time = false")
+	}
+	if got := removeAll(q); !slices.Equal(got, []string{"critical"}) {
+		t.Errorf("dequeued %q, want [critical]", got)
+	}
+}
+
+func TestProjectedWaitByTier(t *testing.T) {
+	q, _ := newTimedQueue(t, time.Second)
+	for _, crit := range slices.Repeat(shedding.AllCriticalities, 2) {
+		q.Insert(context.Background(), crit, "a", nil)
+	}
+	// Each tier waits for its own elements and those of the tiers above it,
+	// on top of the queue-wide wait per element
+	for i, crit := range shedding.AllCriticalities {
+		ahead := 2 * (len(shedding.AllCriticalities) - i)
+		if got, want := q.ProjectedWait(crit), time.Duration(ahead+1)*q.ExpectedWait(); got != want {
+			t.Errorf("ProjectedWait(%v) = %v, want %v", crit, got, want)
+		}
+	}
+}
+
+func TestExpectedWaitFor(t *testing.T) {
+	q, _ := newTimedQueue(t, time.Second)
+	for _, crit := range slices.Repeat(shedding.AllCriticalities, 2) {
+		q.Insert(context.Background(), crit, "a", nil)
+	}
+	// The more critical the tier, the fewer elements it waits behind
+	var last time.Duration
+	for i, crit := range shedding.AllCriticalities {
+		got := q.ExpectedWaitFor(crit)
+		if i > 0 && got >= last {
+			t.Errorf("ExpectedWaitFor(%v) = %v, want less than %v for %v", crit, got, last, shedding.AllCriticalities[i-1])
+		}
+		if want := q.ProjectedWait(crit); got != want {
+			t.Errorf("ExpectedWaitFor(%v) = %v, want ProjectedWait's %v", crit, got, want)
+		}
+		last = got
+	}
+	if got, want := q.ExpectedWaitFor(shedding.AllCriticalities[0]), time.Duration(q.Len()+1)*q.ExpectedWait(); got != want {
+		t.Errorf("ExpectedWaitFor(%v) = %v, want %v behind the whole queue", shedding.AllCriticalities[0], got, want)
+	}
+}
+
+func TestReconfigureTimingHistory(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	samples := make([]time.Duration, 10)
+	for i := range samples {
+		samples[i] = time.Duration(i+1) * time.Millisecond
+	}
+	q.Config.TimingHistory = 10
+	q.ImportTiming(samples)
+
+	c := q.Config
+	c.TimingHistory = 4
+	if err := q.Reconfigure(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := q.ExportTiming(); !slices.Equal(got, samples[6:]) {
+		t.Errorf("history after shrinking = %v, want the newest 4 of %v", got, samples)
+	}
+
+	c.TimingHistory = 6
+	if err := q.Reconfigure(c); err != nil {
+		t.Fatal(err)
+	}
+	// The existing samples are kept, and new ones fill up the space
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	for i := 0; i < 3; i++ {
+		q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+		mc.Add(time.Minute)
+		q.Remove()
+	}
+	want := append(slices.Clone(samples[7:]), time.Minute, time.Minute, time.Minute)
+	if got := q.ExportTiming(); !slices.Equal(got, want) {
+		t.Errorf("history after growing = %v, want %v", got, want)
+	}
+}
+
+func TestExplicitZeroDiscardOutliers(t *testing.T) {
+	q := &Queue[string]{}
+	q.Config.TimingHistory = 5
+	q.ImportTiming([]time.Duration{1, 2, 3, 4, 100})
+	q.ExpectedWait()
+	if q.Config.DiscardOutliers != 0 {
+		t.Errorf("DiscardOutliers = %d with an explicit TimingHistory, want 0 kept", q.Config.DiscardOutliers)
+	}
+	// The mean of all five, including the extremes
+	if got := q.ExpectedWait(); got != 22 {
+		t.Errorf("ExpectedWait() = %v, want the untrimmed mean of 22ns", got)
+	}
+
+	small := &Queue[string]{}
+	small.Config.TimingHistory = 1
+	small.ImportTiming([]time.Duration{1, 2, 3})
+	if got := small.ExportTiming(); !slices.Equal(got, []time.Duration{3}) {
+		t.Errorf("with TimingHistory 1, history is %v, want [3ns]", got)
+	}
+}
+
+func TestOutlierTrimDeterministic(t *testing.T) {
+	// Duplicates at both trim boundaries
+	samples := []time.Duration{5, 5, 5, 7, 8, 9, 9, 9, 2, 2}
+	r := rand.New(rand.NewPCG(1, 2))
+	var first time.Duration
+	for i := 0; i < 20; i++ {
+		r.Shuffle(len(samples), func(i, j int) { samples[i], samples[j] = samples[j], samples[i] })
+		q := &Queue[string]{}
+		q.Config.TimingHistory = len(samples)
+		q.Config.DiscardOutliers = 3
+		q.ImportTiming(samples)
+		got := q.ExpectedWait()
+		if i == 0 {
+			first = got
+		} else if got != first {
+			t.Fatalf("estimate %v for %v, but %v for another order of the same samples", got, samples, first)
+		}
+	}
+	// 5, 5, 7, 8 are left
+	if first != 6 {
+		t.Errorf("ExpectedWait() = %v, want 6ns", first)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	q.Config.DryRun = true
+	var reported []string
+	q.Config.OnWouldShed = func(_ shedding.Criticality, v string, _ ShedReason) {
+		reported = append(reported, v)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(2500*time.Millisecond))
+	defer cancel()
+	for _, v := range []string{"a", "b", "c", "d"} {
+		q.Insert(ctx, shedding.Sheddable, v, nil)
+	}
+
+	if n := q.Len(); n != 4 {
+		t.Errorf("Len() = %d, want all 4 kept", n)
+	}
+	if s := q.Stats(); s.WouldShed != 2 || s.Shed != 0 {
+		t.Errorf("Stats() WouldShed = %d, Shed = %d, want 2 and 0", s.WouldShed, s.Shed)
+	}
+	q.Peek()
+	if s := q.Stats(); s.WouldShed != 2 {
+		t.Errorf("WouldShed = %d after another pass, want it still 2", s.WouldShed)
+	}
+	if !slices.Equal(reported, []string{"c", "d"}) {
+		t.Errorf("OnWouldShed got %q, want [c d]", reported)
+	}
+}
+
+func TestLess(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		less      func(a, b shedding.Criticality) bool
+		low, high shedding.Criticality
+	}{
+		{"default", nil, shedding.Sheddable, shedding.Critical},
+		{"inverted", func(a, b shedding.Criticality) bool { return a > b }, 2, 0},
+	} {
+		// Capacity
+		full := &Queue[string]{}
+		full.Config.Less = tc.less
+		full.Config.MaxLen = 1
+		full.Insert(context.Background(), tc.high, "high", nil)
+		full.Insert(context.Background(), tc.low, "low", nil)
+		full.Insert(context.Background(), tc.high, "second high", nil)
+		if got := removeAll(full); !slices.Equal(got, []string{"high"}) {
+			t.Errorf("%s: full queue kept %q, want [high]", tc.name, got)
+		}
+
+		// Shedding the less critical to save the more critical
+		q, mc := newTimedQueue(t, time.Second)
+		q.Config.Less = tc.less
+		later, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Hour))
+		soon, cancelSoon := context.WithDeadline(context.Background(), mc.Now().Add(2500*time.Millisecond))
+		q.Insert(later, tc.low, "first", nil)
+		q.Insert(later, tc.low, "second", nil)
+		q.Insert(soon, tc.high, "high", nil)
+		if got := removeAll(q); !slices.Equal(got, []string{"first", "high"}) {
+			t.Errorf("%s: dequeued %q, want [first high]", tc.name, got)
+		}
+		cancel()
+		cancelSoon()
+	}
+}
+
+func TestMinExpectedWait(t *testing.T) {
+	q := &Queue[string]{}
+	q.Config.TimingHistory = 4
+	q.Config.MinExpectedWait = 10 * time.Millisecond
+	q.ImportTiming(slices.Repeat([]time.Duration{time.Millisecond}, 4))
+	if got := q.ExpectedWait(); got != 10*time.Millisecond {
+		t.Errorf("ExpectedWait() = %v with intervals of 1ms, want the 10ms floor", got)
+	}
+	// Above the floor, the observed value is used as it is
+	q.ImportTiming(slices.Repeat([]time.Duration{50 * time.Millisecond}, 4))
+	if got := q.ExpectedWait(); got != 50*time.Millisecond {
+		t.Errorf("ExpectedWait() = %v with intervals of 50ms, want 50ms", got)
+	}
+}
+
+func TestExportImportTiming(t *testing.T) {
+	old, _ := newTimedQueue(t, 20*time.Millisecond)
+	fresh := &Queue[string]{}
+	fresh.Config.TimingHistory = old.Config.TimingHistory
+	fresh.ImportTiming(old.ExportTiming())
+	if got, want := fresh.ExportTiming(), old.ExportTiming(); !slices.Equal(got, want) {
+		t.Errorf("restored history %v, want %v", got, want)
+	}
+	if got := fresh.ExpectedWait(); got != 20*time.Millisecond || fresh.IsWarmingUp() {
+		t.Errorf("restored queue has ExpectedWait() = %v, want 20ms without warming up", got)
+	}
+
+	// A longer history than will fit keeps the most recent
+	fresh.ImportTiming([]time.Duration{1, 2, 3, 4, 5, 6})
+	if got := fresh.ExportTiming(); !slices.Equal(got, []time.Duration{3, 4, 5, 6}) {
+		t.Errorf("history %v after importing 6 into 4, want the last four", got)
+	}
+
+	ewma := &Queue[string]{}
+	ewma.Config.TimingHistory = 4
+	ewma.Config.UseEWMA = true
+	ewma.ImportTiming(slices.Repeat([]time.Duration{time.Second}, 10))
+	restored := &Queue[string]{}
+	restored.Config = ewma.Config
+	restored.ImportTiming(ewma.ExportTiming())
+	if got, want := restored.ExpectedWait(), ewma.ExpectedWait(); got != want {
+		t.Errorf("restored EWMA estimate %v, want %v", got, want)
+	}
+}
+
+func TestTierDeadline(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	q.Config.TierDeadline = map[shedding.Criticality]time.Duration{shedding.Sheddable: 1500 * time.Millisecond}
+	explicit, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Hour))
+	defer cancel()
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	// Due at 2s, past its tier's deadline
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+	// Also due at 2s, but with its own deadline
+	q.Insert(explicit, shedding.Sheddable, "explicit", nil)
+	// No deadline for its tier
+	q.Insert(context.Background(), shedding.Critical, "critical", nil)
+
+	if got, want := removeAll(q), []string{"a", "explicit", "critical"}; !slices.Equal(got, want) {
+		t.Errorf("dequeued %q, want %q", got, want)
+	}
+}
+
+func TestRemoveNoTiming(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	history, last := q.ExportTiming(), q.Stats().LastDequeue
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	mc.Add(time.Hour)
+	if v, ok := q.RemoveNoTiming(); !ok || v != "a" {
+		t.Fatalf("RemoveNoTiming() = %q, %v, want a", v, ok)
+	}
+	if got := q.ExpectedWait(); got != time.Second {
+		t.Errorf("ExpectedWait() = %v after RemoveNoTiming, want 1s unchanged", got)
+	}
+	if got := q.ExportTiming(); !slices.Equal(got, history) {
+		t.Errorf("timing history %v after RemoveNoTiming, want %v", got, history)
+	}
+	if got := q.Stats().LastDequeue; !got.Equal(last) {
+		t.Errorf("LastDequeue moved to %v, want %v", got, last)
+	}
+}
+
+func TestReconfigureEstimator(t *testing.T) {
+	q := &Queue[string]{}
+	q.Config.TimingHistory = 10
+	q.Config.DiscardOutliers = -1
+	q.ImportTiming([]time.Duration{1, 1, 1, 1, 1, 1, 1, 1, 1, 91})
+	if got := q.ExpectedWait(); got != 10 {
+		t.Fatalf("ExpectedWait() = %v, want the mean, 10ns", got)
+	}
+	c := q.Config
+	c.Estimator = EstimatorP50
+	if err := q.Reconfigure(c); err != nil {
+		t.Fatal(err)
+	}
+	// No dequeue in between, but the estimate is recomputed for the new mode
+	if got := q.ExpectedWait(); got != 1 {
+		t.Errorf("ExpectedWait() = %v after switching to EstimatorP50, want the median, 1ns", got)
+	}
+}
+
+func TestProcessingReserve(t *testing.T) {
+	for _, tc := range []struct {
+		reserve time.Duration
+		kept    int
+	}{
+		{0, 3},
+		{time.Second, 2},
+	} {
+		q, mc := newTimedQueue(t, time.Second)
+		q.Config.ProcessingReserve = tc.reserve
+		ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(3500*time.Millisecond))
+		for i := 0; i < 3; i++ {
+			q.Insert(ctx, shedding.Sheddable, "a", nil)
+		}
+		// The third is due at 3s, with only 500ms left to process it
+		if n := q.Len(); n != tc.kept {
+			t.Errorf("ProcessingReserve %v: kept %d of 3, want %d", tc.reserve, n, tc.kept)
+		}
+		cancel()
+	}
+}
+
+func TestLogger(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	var buf bytes.Buffer
+	q.Config.Logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(500*time.Millisecond))
+	defer cancel()
+	q.Insert(ctx, shedding.Critical, "late", nil)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("logged %q: %v", buf.String(), err)
+	}
+	for k, want := range map[string]any{
+		"level":         "DEBUG",
+		"msg":           "shed",
+		"criticality":   "CRITICAL",
+		"reason":        "deadline",
+		"expected_wait": float64(time.Second),
+	} {
+		if record[k] != want {
+			t.Errorf("logged %s = %v, want %v", k, record[k], want)
+		}
+	}
+	for _, k := range []string{"deadline", "projected"} {
+		if _, ok := record[k]; !ok {
+			t.Errorf("logged %v without %s", record, k)
+		}
+	}
+}
+
+func TestInFlightBias(t *testing.T) {
+	for _, bias := range []bool{false, true} {
+		q, mc := newTimedQueue(t, 10*time.Minute)
+		q.Config.InFlightBias = bias
+		q.Insert(context.Background(), shedding.Sheddable, "in flight", nil)
+		q.Insert(context.Background(), shedding.Sheddable, "next", nil)
+		q.Remove()
+		// The consumer is stuck on "in flight", with "next" waiting
+		mc.Add(30 * time.Minute)
+
+		deadline, cancel := context.WithDeadline(context.Background(), mc.Now().Add(25*time.Minute))
+		ok := q.TryInsert(deadline, shedding.Critical, "deadline", cancel)
+		if ok == bias {
+			t.Errorf("InFlightBias=%v: TryInsert() = %v", bias, ok)
+		}
+	}
+}
+
+func TestAutoOutliers(t *testing.T) {
+	tight := make([]time.Duration, 100)
+	for i := range tight {
+		tight[i] = time.Duration(99+i%3) * time.Millisecond
+	}
+	noisy := slices.Repeat([]time.Duration{10 * time.Millisecond}, 90)
+	noisy = append(noisy, slices.Repeat([]time.Duration{time.Second}, 10)...)
+
+	for _, tc := range []struct {
+		name    string
+		samples []time.Duration
+		discard int
+		want    time.Duration // zero for the mean of every sample
+	}{
+		{"tight", tight, 0, 0},
+		{"noisy", noisy, 10, 10 * time.Millisecond},
+	} {
+		if got := autoOutliers(tc.samples, nil); got != tc.discard {
+			t.Errorf("%s: autoOutliers() = %d, want %d", tc.name, got, tc.discard)
+		}
+		q := &Queue[string]{}
+		q.Config.TimingHistory = len(tc.samples)
+		q.Config.AutoOutliers = true
+		q.ImportTiming(tc.samples)
+		want := tc.want
+		if want == 0 {
+			want = sum(tc.samples) / time.Duration(len(tc.samples))
+		}
+		if got := q.ExpectedWait(); got != want {
+			t.Errorf("%s: ExpectedWait() = %v, want %v", tc.name, got, want)
+		}
+	}
+}
+
+func TestInFlightBiasIgnoresIdleTime(t *testing.T) {
+	q, mc := newTimedQueue(t, 10*time.Millisecond)
+	q.Config.InFlightBias = true
+	// The consumers sit idle on an empty queue
+	mc.Add(10 * time.Second)
+
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Second))
+	defer cancel()
+	if !q.TryInsert(ctx, shedding.CriticalPlus, "a", nil) {
+		t.Error("element inserted into an idle queue was shed")
+	}
+	if _, ok := q.Remove(); !ok {
+		t.Error("element inserted into an idle queue was shed before Remove")
+	}
+}
+
+func TestDryRunRejectLate(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	q.Config.RejectLate = true
+	q.Config.DryRun = true
+	q.Insert(context.Background(), shedding.Sheddable, "a", nil)
+	q.Insert(context.Background(), shedding.Sheddable, "b", nil)
+
+	ctx, cancel := context.WithDeadline(context.Background(), mc.Now().Add(time.Second))
+	defer cancel()
+	if !q.TryInsert(ctx, shedding.Sheddable, "late", nil) {
+		t.Error("late element rejected under DryRun")
+	}
+	if n := q.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+	if s := q.Stats(); s.WouldShed != 1 || s.ShedByReason[ShedDeadline] != 0 {
+		t.Errorf("Stats() WouldShed = %d, shed for deadline = %d, want 1 and 0", s.WouldShed, s.ShedByReason[ShedDeadline])
+	}
+}
+
+func TestReconfigureKeepsHooks(t *testing.T) {
+	q, mc := newTimedQueue(t, time.Second)
+	shed := 0
+	q.Config.OnShed = func(shedding.Criticality, string, ShedReason) { shed++ }
+
+	if err := q.Reconfigure(Config[string]{TimingHistory: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if q.Config.Clock != mc {
+		t.Error("Reconfigure replaced the mock clock")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.Insert(ctx, shedding.Sheddable, "cancelled", nil)
+	if shed != 1 {
+		t.Errorf("OnShed called %d times after Reconfigure, want 1", shed)
+	}
+}
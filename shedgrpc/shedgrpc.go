@@ -0,0 +1,108 @@
+// Package shedgrpc sheds gRPC calls through a queue.Queue, according to their
+// criticality and deadline
+package shedgrpc
+
+import (
+	"context"
+
+	"github.com/asuffield/shedding"
+	"github.com/asuffield/shedding/internal/dispatch"
+	"github.com/asuffield/shedding/queue"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultKey is the default metadata key carrying the criticality
+const DefaultKey = "x-criticality"
+
+// Opts configures the interceptors
+type Opts struct {
+	// Key is the metadata key carrying the call's criticality, as formatted by
+	// Criticality.String. Defaults to DefaultKey.
+	Key string
+	// Default is the criticality of calls without valid metadata
+	Default shedding.Criticality
+	// Concurrency is the number of calls handled at once. Defaults to 1.
+	Concurrency int
+}
+
+func (o *Opts) defaults() {
+	if o.Key == "" {
+		o.Key = DefaultKey
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+}
+
+// Call is a queued unary call
+type Call struct {
+	FullMethod string
+	ticket     *dispatch.Ticket
+}
+
+// UnaryServerInterceptor returns an interceptor which inserts each call into
+// q, and handles calls as they are dequeued, at most opts.Concurrency at a
+// time. The incoming context's deadline is used for shedding. Shed calls fail
+// with codes.DeadlineExceeded if they were shed for their deadline, and
+// codes.Unavailable otherwise. The interceptor takes over consuming from q,
+// and installs q.Config.OnShed and q.Config.OnDiscard, calling any previous
+// hooks; it must be created before q is used. Closing q stops handling calls.
+func UnaryServerInterceptor(q *queue.Queue[*Call], opts Opts) grpc.UnaryServerInterceptor {
+	opts.defaults()
+	pool := dispatch.Start(q, opts.Concurrency, func(c *Call) *dispatch.Ticket { return c.ticket })
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		crit := opts.Default
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if v := md.Get(opts.Key); len(v) > 0 {
+				if c, err := shedding.ParseCriticality(v[0]); err == nil {
+					crit = c
+				}
+			}
+		}
+		ctx = shedding.WithCriticality(ctx, crit)
+		c := &Call{FullMethod: info.FullMethod, ticket: dispatch.NewTicket()}
+
+		var outcome dispatch.Outcome
+		var reason queue.ShedReason
+		if q.Insert(ctx, crit, c, nil) {
+			outcome, reason = pool.Wait(ctx, c.ticket)
+		} else {
+			outcome, reason = c.ticket.Rejected()
+		}
+		switch outcome {
+		case dispatch.Granted:
+			defer c.ticket.Done()
+			return handler(ctx, req)
+		case dispatch.Shed:
+			switch {
+			case reason == queue.ShedCancelled && ctx.Err() != nil:
+				return nil, status.FromContextError(ctx.Err()).Err()
+			case reason == queue.ShedDeadline:
+				return nil, status.Errorf(codes.DeadlineExceeded, "call shed: %v", reason)
+			}
+			return nil, status.Errorf(codes.Unavailable, "call shed: %v", reason)
+		case dispatch.Discarded:
+			return nil, status.Error(codes.Unavailable, "call discarded")
+		case dispatch.Cancelled:
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		return nil, status.Error(codes.Unavailable, "server shutting down")
+	}
+}
+
+// UnaryClientInterceptor returns an interceptor which sends the criticality
+// stored in each call's context by shedding.WithCriticality as metadata, for
+// UnaryServerInterceptor
+func UnaryClientInterceptor(opts Opts) grpc.UnaryClientInterceptor {
+	opts.defaults()
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		if crit, ok := shedding.FromContext(ctx); ok {
+			ctx = metadata.AppendToOutgoingContext(ctx, opts.Key, crit.String())
+		}
+		return invoker(ctx, method, req, reply, cc, callOpts...)
+	}
+}
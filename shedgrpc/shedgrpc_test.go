@@ -0,0 +1,173 @@
+package shedgrpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/asuffield/shedding/queue"
+	"github.com/benbjohnson/clock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// serve starts an in-process health server behind UnaryServerInterceptor,
+// calling inner for each call it handles, and returns a client for it
+func serve(t *testing.T, q *queue.Queue[*Call], inner grpc.UnaryServerInterceptor) healthpb.HealthClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(UnaryServerInterceptor(q, Opts{}), inner))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor(Opts{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+// inserts is a queue.Metrics that reports the criticality of each insert
+type inserts chan shedding.Criticality
+
+func (m inserts) Inserted(crit shedding.Criticality)          { m <- crit }
+func (m inserts) Removed(shedding.Criticality, time.Duration) {}
+func (m inserts) Shed(shedding.Criticality, queue.ShedReason) {}
+
+// wait blocks until an element of criticality crit has been inserted
+func (m inserts) wait(crit shedding.Criticality) {
+	for c := range m {
+		if c == crit {
+			return
+		}
+	}
+}
+
+func TestShed(t *testing.T) {
+	mc := clock.NewMock()
+	// Priming the estimate below moves the mock clock on by two seconds, after
+	// which it is the same as the real one that call deadlines are set from
+	mc.Set(time.Now().Add(-2 * time.Second))
+	q := &queue.Queue[*Call]{}
+	defer q.Close()
+	q.Config.Clock = mc
+	q.Config.TimingHistory = 2
+	q.Config.MaxLen = 1
+	inserted := make(inserts, 20)
+	q.Config.Metrics = inserted
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	client := serve(t, q, func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		// Critical calls block the only worker, so that others queue up
+		if crit, _ := shedding.FromContext(ctx); crit == shedding.Critical {
+			started <- struct{}{}
+			<-release
+		}
+		return handler(ctx, req)
+	})
+	check := func(ctx context.Context, crit shedding.Criticality) error {
+		_, err := client.Check(shedding.WithCriticality(ctx, crit), &healthpb.HealthCheckRequest{})
+		return err
+	}
+
+	// One call a second, so each is expected to wait a second
+	for i := 0; i <= q.Config.TimingHistory; i++ {
+		if i > 0 {
+			mc.Add(time.Second)
+		}
+		if err := check(context.Background(), shedding.Sheddable); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := check(ctx, shedding.CriticalPlus)
+	if s := status.Convert(err); s.Code() != codes.DeadlineExceeded || !strings.Contains(s.Message(), "shed") {
+		t.Errorf("call which can't be dequeued in time failed with %v, want DeadlineExceeded from the server", err)
+	}
+
+	busy := make(chan error, 1)
+	go func() { busy <- check(context.Background(), shedding.Critical) }()
+	<-started
+	queued := make(chan error, 1)
+	go func() { queued <- check(context.Background(), shedding.Sheddable) }()
+	inserted.wait(shedding.Sheddable)
+	// The queue is full, so the queued call makes way for a more critical one
+	criticalPlus := make(chan error, 1)
+	go func() { criticalPlus <- check(context.Background(), shedding.CriticalPlus) }()
+	if err := <-queued; status.Code(err) != codes.Unavailable {
+		t.Errorf("call shed for capacity failed with %v, want Unavailable", err)
+	}
+	close(release)
+	if err := <-busy; err != nil {
+		t.Error(err)
+	}
+	if err := <-criticalPlus; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCriticality(t *testing.T) {
+	q := &queue.Queue[*Call]{}
+	defer q.Close()
+	got := make(chan shedding.Criticality, 1)
+	client := serve(t, q, func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		crit, _ := shedding.FromContext(ctx)
+		got <- crit
+		return handler(ctx, req)
+	})
+
+	ctx := shedding.WithCriticality(context.Background(), shedding.CriticalPlus)
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if crit := <-got; crit != shedding.CriticalPlus {
+		t.Errorf("server saw criticality %v, want %v", crit, shedding.CriticalPlus)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	q := &queue.Queue[*Call]{}
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	client := serve(t, q, func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		started <- struct{}{}
+		<-release
+		return handler(ctx, req)
+	})
+
+	busy := make(chan error, 1)
+	go func() {
+		_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		busy <- err
+	}()
+	<-started
+	// The queue is closed, but the worker is still busy
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("call during shutdown failed with %v, want Unavailable", err)
+	}
+	close(release)
+	if err := <-busy; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,93 @@
+// Package shedhttp sheds HTTP requests through a queue.Queue, according to
+// their criticality and deadline
+package shedhttp
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/asuffield/shedding/internal/dispatch"
+	"github.com/asuffield/shedding/queue"
+)
+
+// Opts configures Middleware
+type Opts struct {
+	// Header holds the request's criticality, as parsed by
+	// shedding.ParseCriticality. Defaults to "X-Criticality".
+	Header string
+	// Default is the criticality of requests without a valid header
+	Default shedding.Criticality
+	// Concurrency is the number of requests handled at once. Defaults to 1.
+	Concurrency int
+	// RetryAfter is sent with 503 responses for shed requests. Defaults to one
+	// second.
+	RetryAfter time.Duration
+}
+
+type ticketKey struct{}
+
+func ticket(r *http.Request) *dispatch.Ticket {
+	return r.Context().Value(ticketKey{}).(*dispatch.Ticket)
+}
+
+// Middleware returns a handler wrapper which inserts each request into q, and
+// serves requests as they are dequeued, at most opts.Concurrency at a time.
+// The request context's deadline is used for shedding, and shed requests get
+// 503 Service Unavailable with a Retry-After header. Middleware takes over
+// consuming from q, and installs q.Config.OnShed and q.Config.OnDiscard,
+// calling any previous hooks; it must be called before q is used. Closing q stops serving requests.
+func Middleware(q *queue.Queue[*http.Request], opts Opts) func(http.Handler) http.Handler {
+	if opts.Header == "" {
+		opts.Header = "X-Criticality"
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.RetryAfter <= 0 {
+		opts.RetryAfter = time.Second
+	}
+	retryAfter := strconv.Itoa(int(math.Ceil(opts.RetryAfter.Seconds())))
+	pool := dispatch.Start(q, opts.Concurrency, ticket)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			crit, err := shedding.ParseCriticality(r.Header.Get(opts.Header))
+			if err != nil {
+				crit = opts.Default
+			}
+			t := dispatch.NewTicket()
+			ctx := shedding.WithCriticality(r.Context(), crit)
+			r = r.WithContext(context.WithValue(ctx, ticketKey{}, t))
+
+			var outcome dispatch.Outcome
+			var reason queue.ShedReason
+			if q.Insert(r.Context(), crit, r, nil) {
+				outcome, reason = pool.Wait(r.Context(), t)
+			} else {
+				outcome, reason = t.Rejected()
+			}
+			if outcome == dispatch.Granted {
+				defer t.Done()
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Retry-After", retryAfter)
+			msg := "server shutting down"
+			switch outcome {
+			case dispatch.Shed:
+				msg = fmt.Sprintf("request shed: %v", reason)
+			case dispatch.Discarded:
+				msg = "request discarded"
+			case dispatch.Cancelled:
+				msg = "request cancelled"
+			}
+			http.Error(w, msg, http.StatusServiceUnavailable)
+		})
+	}
+}
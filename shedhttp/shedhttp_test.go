@@ -0,0 +1,160 @@
+package shedhttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asuffield/shedding"
+	"github.com/asuffield/shedding/queue"
+)
+
+// inserts is a queue.Metrics that reports the criticality of each insert
+type inserts chan shedding.Criticality
+
+func (m inserts) Inserted(crit shedding.Criticality)          { m <- crit }
+func (m inserts) Removed(shedding.Criticality, time.Duration) {}
+func (m inserts) Shed(shedding.Criticality, queue.ShedReason) {}
+
+// wait blocks until an element of criticality crit has been inserted
+func (m inserts) wait(crit shedding.Criticality) {
+	for c := range m {
+		if c == crit {
+			return
+		}
+	}
+}
+
+// get sends a request with the given criticality to url, and delivers the
+// response on the returned channel
+func get(t *testing.T, url string, crit shedding.Criticality) <-chan *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Criticality", crit.String())
+	ch := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+		} else {
+			resp.Body.Close()
+		}
+		ch <- resp
+	}()
+	return ch
+}
+
+func TestMiddlewareSheds(t *testing.T) {
+	q := &queue.Queue[*http.Request]{}
+	defer q.Close()
+	q.Config.MaxLen = 1
+	inserted := make(inserts, 10)
+	q.Config.Metrics = inserted
+	release := make(chan struct{})
+	started := make(chan string, 2)
+	h := Middleware(q, Opts{RetryAfter: 3 * time.Second})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.Header.Get("X-Criticality")
+		<-release
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// Occupy the only worker, so the queue fills up behind it
+	busy := get(t, srv.URL, shedding.Critical)
+	<-started
+	sheddable := get(t, srv.URL, shedding.Sheddable)
+	inserted.wait(shedding.Sheddable)
+	// There's no room left, so the sheddable request makes way
+	criticalPlus := get(t, srv.URL, shedding.CriticalPlus)
+
+	if resp := <-sheddable; resp != nil {
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("sheddable request got status %d, want 503", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Retry-After"); got != "3" {
+			t.Errorf("sheddable request got Retry-After %q, want 3", got)
+		}
+	}
+	close(release)
+	for _, resp := range []*http.Response{<-busy, <-criticalPlus} {
+		if resp != nil && resp.StatusCode != http.StatusOK {
+			t.Errorf("request got status %d, want 200", resp.StatusCode)
+		}
+	}
+	if crit := <-started; crit != shedding.CriticalPlus.String() {
+		t.Errorf("handler served %s, want the CriticalPlus request", crit)
+	}
+}
+
+func TestMiddlewareClear(t *testing.T) {
+	q := &queue.Queue[*http.Request]{}
+	defer q.Close()
+	inserted := make(inserts, 10)
+	q.Config.Metrics = inserted
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	h := Middleware(q, Opts{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	busy := get(t, srv.URL, shedding.Critical)
+	<-started
+	queued := get(t, srv.URL, shedding.Sheddable)
+	inserted.wait(shedding.Sheddable)
+	q.Clear()
+	if resp := <-queued; resp != nil && resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("cleared request got status %d, want 503", resp.StatusCode)
+	}
+	close(release)
+	if resp := <-busy; resp != nil && resp.StatusCode != http.StatusOK {
+		t.Errorf("busy request got status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestMiddlewareShutdown(t *testing.T) {
+	q := &queue.Queue[*http.Request]{}
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	h := Middleware(q, Opts{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	busy := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		busy <- err
+	}()
+	<-started
+	// The queue is closed, but the worker is still busy
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("request during shutdown got status %d, want 503", resp.StatusCode)
+	}
+	close(release)
+	if err := <-busy; err != nil {
+		t.Error(err)
+	}
+}